@@ -0,0 +1,278 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+// leaderctl inspects and manipulates leader election records stored in etcd
+// by resourcelock.LeaseLock.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/khh403/leaderelection"
+	"github.com/khh403/leaderelection/resourcelock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const usage = `Usage: leaderctl [flags] <command> [args]
+
+Commands:
+  list <prefix>   list the election records under an etcd prefix
+  get <key>       show the election record stored under key
+  release <key>   force-clear the holder of the election record under key
+  watch <key>     stream changes of the election record under key
+
+A key is the namespace and the name of a LeaseLock joined by "/".
+
+Flags:
+`
+
+// leaseStatus is the printed form of an election record.
+type leaseStatus struct {
+	Key                  string    `json:"key"`
+	HolderIdentity       string    `json:"holderIdentity"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	LeaderTransitions    int       `json:"leaderTransitions"`
+	// RemainingSeconds is the time left until the lease expires, 0 if expired
+	RemainingSeconds int64 `json:"remainingSeconds"`
+}
+
+func main() {
+	var etcdEndpoints, etcdCertFilePath, output string
+	var timeout time.Duration
+
+	flag.StringVar(&etcdEndpoints, "etcd-endpoints", "https://127.0.0.1:2379", "Comma-separated list of etcd endpoints")
+	flag.StringVar(&etcdCertFilePath, "etcd-cert", "", "relative path of etcd cert files, TLS is disabled if empty")
+	flag.StringVar(&output, "o", "table", "output format, one of table or json")
+	flag.DurationVar(&timeout, "timeout", 5*time.Second, "timeout of etcd requests")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 || (output != "table" && output != "json") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	etcdConfig := clientv3.Config{
+		Endpoints:   strings.Split(etcdEndpoints, ","),
+		DialTimeout: timeout,
+	}
+	if etcdCertFilePath != "" {
+		tlsConfig, err := leaderelection.GetTlsConfig(etcdCertFilePath)
+		if err != nil {
+			fail(fmt.Errorf("GetTlsConfig fail, error: %w", err))
+		}
+		etcdConfig.TLS = tlsConfig
+	}
+	client, err := clientv3.New(etcdConfig)
+	if err != nil {
+		fail(fmt.Errorf("error creating etcd client: %w", err))
+	}
+	defer client.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	c := &command{
+		client:  client,
+		timeout: timeout,
+		out:     os.Stdout,
+		json:    output == "json",
+	}
+	switch arg := flag.Arg(1); flag.Arg(0) {
+	case "list":
+		err = c.list(ctx, arg)
+	case "get":
+		err = c.get(ctx, arg)
+	case "release":
+		err = c.release(ctx, arg)
+	case "watch":
+		err = c.watch(ctx, arg)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "leaderctl: %v\n", err)
+	os.Exit(1)
+}
+
+type command struct {
+	client  *clientv3.Client
+	timeout time.Duration
+	out     io.Writer
+	json    bool
+}
+
+// list prints the election records of all keys under prefix.
+func (c *command) list(ctx context.Context, prefix string) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	resp, err := c.client.Get(timeoutCtx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	statuses := []leaseStatus{}
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if strings.Contains(key, "/"+resourcelock.CandidatesKeySegment+"/") {
+			continue
+		}
+		var lease coordinationv1.Lease
+		if err := json.Unmarshal(kv.Value, &lease); err != nil || lease.Spec.HolderIdentity == nil {
+			// not an election record
+			continue
+		}
+		statuses = append(statuses, newLeaseStatus(key, resourcelock.LeaseSpecToLeaderElectionRecord(&lease.Spec)))
+	}
+	return c.print(statuses...)
+}
+
+// get prints the election record under key.
+func (c *command) get(ctx context.Context, key string) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	record, _, err := c.lock(key).Get(timeoutCtx)
+	if err != nil {
+		return err
+	}
+	return c.print(newLeaseStatus(key, record))
+}
+
+// release clears the holder of the election record under key, so that any
+// candidate may acquire it right away.
+func (c *command) release(ctx context.Context, key string) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	lock := c.lock(key)
+	record, _, err := lock.Get(timeoutCtx)
+	if err != nil {
+		return err
+	}
+
+	now := metav1.NewTime(time.Now())
+	released := resourcelock.LeaderElectionRecord{
+		LeaderTransitions:    record.LeaderTransitions,
+		LeaseDurationSeconds: 1,
+		RenewTime:            now,
+		AcquireTime:          now,
+	}
+	if err := lock.Update(timeoutCtx, released); err != nil {
+		if resourcelock.IsConflict(err) {
+			return fmt.Errorf("record %v changed while releasing it, retry: %w", key, err)
+		}
+		return err
+	}
+	return c.print(newLeaseStatus(key, &released))
+}
+
+// watch prints the election record under key every time it changes, until
+// ctx is done.
+func (c *command) watch(ctx context.Context, key string) error {
+	for event := range c.lock(key).Watch(ctx) {
+		if event.Record == nil {
+			fmt.Fprintf(c.out, "%v deleted\n", key)
+			continue
+		}
+		if err := c.print(newLeaseStatus(key, event.Record)); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() == nil {
+		return fmt.Errorf("watch on %v broke", key)
+	}
+	return nil
+}
+
+// lock returns the LeaseLock stored under key.
+func (c *command) lock(key string) *resourcelock.LeaseLock {
+	return &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: path.Dir(key),
+			Name:      path.Base(key),
+		},
+		Client: c.client,
+	}
+}
+
+func newLeaseStatus(key string, record *resourcelock.LeaderElectionRecord) leaseStatus {
+	expiry := record.RenewTime.Add(time.Duration(record.LeaseDurationSeconds) * time.Second)
+	remaining := time.Until(expiry)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return leaseStatus{
+		Key:                  key,
+		HolderIdentity:       record.HolderIdentity,
+		AcquireTime:          record.AcquireTime.Time,
+		RenewTime:            record.RenewTime.Time,
+		LeaseDurationSeconds: record.LeaseDurationSeconds,
+		LeaderTransitions:    record.LeaderTransitions,
+		RemainingSeconds:     int64(remaining.Seconds()),
+	}
+}
+
+// print writes statuses as a table or as JSON, one object per status.
+func (c *command) print(statuses ...leaseStatus) error {
+	if c.json {
+		encoder := json.NewEncoder(c.out)
+		for _, status := range statuses {
+			if err := encoder.Encode(status); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tHOLDER\tACQUIRED\tRENEWED\tTRANSITIONS\tREMAINING")
+	for _, status := range statuses {
+		holder := status.HolderIdentity
+		if holder == "" {
+			holder = "<none>"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			status.Key,
+			holder,
+			status.AcquireTime.Format(time.RFC3339),
+			status.RenewTime.Format(time.RFC3339),
+			status.LeaderTransitions,
+			time.Duration(status.RemainingSeconds)*time.Second,
+		)
+	}
+	return w.Flush()
+}
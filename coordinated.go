@@ -0,0 +1,135 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"context"
+	"strings"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/klog/v2"
+)
+
+// In coordinated mode the candidates do not race for the lease. Every
+// candidate registers with the lock, and only the candidate picked by the
+// Strategy acquires a free or expired lease. The leader keeps consulting the
+// Strategy and hands over leadership to the picked candidate when it is no
+// longer the pick itself, e.g. when a candidate with a newer binary version
+// joined during a rolling upgrade.
+
+// Strategy picks the leader of a coordinated election.
+type Strategy interface {
+	// Pick returns the identity of the candidate that should lead, given
+	// the current leader and the live candidates. leader is empty if the
+	// lease is free or expired. An empty identity lets no candidate lead.
+	Pick(leader string, candidates []rl.Candidate) string
+}
+
+// StrategyFunc adapts a function to a Strategy.
+type StrategyFunc func(leader string, candidates []rl.Candidate) string
+
+// Pick calls f(leader, candidates).
+func (f StrategyFunc) Pick(leader string, candidates []rl.Candidate) string {
+	return f(leader, candidates)
+}
+
+// NewestVersionStrategy picks the candidate with the highest priority and,
+// among those, the newest binary version. Binary versions that cannot be
+// parsed are older than any other version. The current leader is kept
+// unless another candidate is preferred, remaining ties go to the candidate
+// that started first.
+type NewestVersionStrategy struct{}
+
+// Pick implements Strategy.
+func (NewestVersionStrategy) Pick(leader string, candidates []rl.Candidate) string {
+	var best *rl.Candidate
+	for i := range candidates {
+		if best == nil || preferCandidate(&candidates[i], best, leader) {
+			best = &candidates[i]
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Identity
+}
+
+// preferCandidate reports whether a should lead rather than b.
+func preferCandidate(a, b *rl.Candidate, leader string) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if c := compareVersions(a.BinaryVersion, b.BinaryVersion); c != 0 {
+		return c > 0
+	}
+	if a.Identity == leader || b.Identity == leader {
+		return a.Identity == leader
+	}
+	if !a.StartTime.Equal(&b.StartTime) {
+		return a.StartTime.Before(&b.StartTime)
+	}
+	return strings.Compare(a.Identity, b.Identity) < 0
+}
+
+// compareVersions returns a positive number if version a is newer than b,
+// a negative number if it is older and zero if they are equal.
+func compareVersions(a, b string) int {
+	va, errA := version.ParseGeneric(a)
+	vb, errB := version.ParseGeneric(b)
+	switch {
+	case errA != nil && errB != nil:
+		return 0
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	case vb.LessThan(va):
+		return 1
+	case va.LessThan(vb):
+		return -1
+	default:
+		return 0
+	}
+}
+
+// pickLeader returns the candidate picked by the strategy, given the current
+// leader.
+func (le *LeaderElector) pickLeader(ctx context.Context, leader string) (string, error) {
+	candidates, err := le.config.Lock.(rl.CandidateRegistry).Candidates(ctx)
+	if err != nil {
+		return "", err
+	}
+	return le.config.Strategy.Pick(leader, candidates), nil
+}
+
+// maybeHandOver hands over leadership to the candidate picked by the
+// strategy in coordinated mode, if that is not this client.
+func (le *LeaderElector) maybeHandOver(ctx context.Context) {
+	if !le.config.Coordinated {
+		return
+	}
+	identity := le.config.Lock.Identity()
+	pick, err := le.pickLeader(ctx, identity)
+	if err != nil {
+		klog.Errorf("error picking leader of %v: %v", le.config.Lock.Describe(), err)
+		return
+	}
+	if pick == "" || pick == identity {
+		return
+	}
+	klog.Infof("handing over lease %v to %v picked by the strategy", le.config.Lock.Describe(), pick)
+	le.requestTransfer(pick)
+}
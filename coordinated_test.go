@@ -0,0 +1,184 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+	"github.com/khh403/leaderelection/resourcelock/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestNewestVersionStrategyPick(t *testing.T) {
+	early := metav1.NewTime(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	late := metav1.NewTime(early.Add(time.Minute))
+	tests := []struct {
+		name       string
+		leader     string
+		candidates []rl.Candidate
+		want       string
+	}{
+		{
+			name: "no candidates",
+			want: "",
+		},
+		{
+			name: "priority before version",
+			candidates: []rl.Candidate{
+				{Identity: "a", Priority: 1, BinaryVersion: "v1.2.0"},
+				{Identity: "b", Priority: 2, BinaryVersion: "v1.1.0"},
+			},
+			want: "b",
+		},
+		{
+			name: "newest version",
+			candidates: []rl.Candidate{
+				{Identity: "a", BinaryVersion: "v1.9.0"},
+				{Identity: "b", BinaryVersion: "v1.10.0"},
+			},
+			want: "b",
+		},
+		{
+			name:   "newer version than the leader",
+			leader: "a",
+			candidates: []rl.Candidate{
+				{Identity: "a", BinaryVersion: "v1.1.0"},
+				{Identity: "b", BinaryVersion: "v1.2.0"},
+			},
+			want: "b",
+		},
+		{
+			name:   "leader kept on a tie",
+			leader: "b",
+			candidates: []rl.Candidate{
+				{Identity: "a", BinaryVersion: "v1.2.0", StartTime: early},
+				{Identity: "b", BinaryVersion: "v1.2.0", StartTime: late},
+			},
+			want: "b",
+		},
+		{
+			name: "first started without a leader",
+			candidates: []rl.Candidate{
+				{Identity: "a", BinaryVersion: "v1.2.0", StartTime: late},
+				{Identity: "b", BinaryVersion: "v1.2.0", StartTime: early},
+			},
+			want: "b",
+		},
+		{
+			name: "identity on a full tie",
+			candidates: []rl.Candidate{
+				{Identity: "b", BinaryVersion: "v1.2.0", StartTime: early},
+				{Identity: "a", BinaryVersion: "v1.2.0", StartTime: early},
+			},
+			want: "a",
+		},
+		{
+			name:   "unparsable version older than any other",
+			leader: "a",
+			candidates: []rl.Candidate{
+				{Identity: "a", BinaryVersion: "dev"},
+				{Identity: "b", BinaryVersion: "v0.0.1"},
+			},
+			want: "b",
+		},
+		{
+			name:   "unparsable versions tie",
+			leader: "b",
+			candidates: []rl.Candidate{
+				{Identity: "a", BinaryVersion: "dev", StartTime: early},
+				{Identity: "b", BinaryVersion: "", StartTime: late},
+			},
+			want: "b",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := (NewestVersionStrategy{}).Pick(test.leader, test.candidates); got != test.want {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+			// the pick must not depend on the order of the candidates
+			reversed := make([]rl.Candidate, len(test.candidates))
+			for i, candidate := range test.candidates {
+				reversed[len(reversed)-1-i] = candidate
+			}
+			if got := (NewestVersionStrategy{}).Pick(test.leader, reversed); got != test.want {
+				t.Errorf("expected %q with the candidates reversed, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestPreferCandidate(t *testing.T) {
+	early := metav1.NewTime(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	late := metav1.NewTime(early.Add(time.Minute))
+	tests := []struct {
+		name   string
+		a, b   rl.Candidate
+		leader string
+		want   bool
+	}{
+		{"higher priority", rl.Candidate{Identity: "a", Priority: 1}, rl.Candidate{Identity: "b"}, "b", true},
+		{"lower priority", rl.Candidate{Identity: "a", BinaryVersion: "v2.0.0"}, rl.Candidate{Identity: "b", Priority: 1}, "a", false},
+		{"newer version", rl.Candidate{Identity: "a", BinaryVersion: "v1.2.0"}, rl.Candidate{Identity: "b", BinaryVersion: "v1.1.0"}, "b", true},
+		{"parsable over unparsable", rl.Candidate{Identity: "a", BinaryVersion: "v0.1.0"}, rl.Candidate{Identity: "b", BinaryVersion: "dev"}, "b", true},
+		{"unparsable under parsable", rl.Candidate{Identity: "a", BinaryVersion: "dev"}, rl.Candidate{Identity: "b", BinaryVersion: "v0.1.0"}, "a", false},
+		{"leader", rl.Candidate{Identity: "a", StartTime: late}, rl.Candidate{Identity: "b", StartTime: early}, "a", true},
+		{"not leader", rl.Candidate{Identity: "a", StartTime: early}, rl.Candidate{Identity: "b", StartTime: late}, "b", false},
+		{"started first", rl.Candidate{Identity: "b", StartTime: early}, rl.Candidate{Identity: "a", StartTime: late}, "", true},
+		{"started later", rl.Candidate{Identity: "a", StartTime: late}, rl.Candidate{Identity: "b", StartTime: early}, "", false},
+		{"lower identity", rl.Candidate{Identity: "a"}, rl.Candidate{Identity: "b"}, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := preferCandidate(&test.a, &test.b, test.leader); got != test.want {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestMayAcquireDefersToStrategy(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	registry := newCandidates()
+	a := rl.Candidate{Identity: "a", BinaryVersion: "v1.1.0"}
+	b := rl.Candidate{Identity: "b", BinaryVersion: "v1.2.0"}
+	le := newTestElector(t, newCandidateLock(store, registry, a), clock)
+	le.config.Coordinated = true
+	le.config.Strategy = NewestVersionStrategy{}
+	registry.set(a)
+	registry.set(b)
+
+	if err := le.tryAcquireOrRenew(context.Background()); !errors.Is(err, errLeaseHeld) {
+		t.Fatalf("expected errLeaseHeld while the strategy picks b, got %v", err)
+	}
+	if record := store.Record(); record != nil {
+		t.Fatalf("expected the lease to stay free, got holder %q", record.HolderIdentity)
+	}
+
+	// a strategy picking a lets it acquire the lease
+	le.config.Strategy = StrategyFunc(func(string, []rl.Candidate) string { return "a" })
+	if err := le.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("error acquiring the lease picked for a: %v", err)
+	}
+	if holder := store.Record().HolderIdentity; holder != "a" {
+		t.Errorf("expected a to hold the lease, got %q", holder)
+	}
+}
@@ -109,7 +109,9 @@ func main() {
 
 	// complete your controller loop here
 	run := func(ctx context.Context) {
-		klog.Info("Controller loop...")
+		// pass the fencing token along with writes to storage guarded by the lease
+		token, _ := leaderelection.FencingTokenFromContext(ctx)
+		klog.Infof("Controller loop with fencing token %d...", token)
 
 		select {}
 	}
@@ -127,6 +129,8 @@ func main() {
 		LockConfig: resourcelock2.ResourceLockConfig{
 			Identity: leaseLockId,
 		},
+		// let etcd expire the lock record if the leader dies
+		BindEtcdLease: true,
 	}
 
 	// start the leader election code loop
@@ -156,10 +160,11 @@ func main() {
 				// we're notified when we start - this is where you would usually put your code
 				run(ctx)
 			},
-			OnStoppedLeading: func() {
+			OnStoppedLeadingWithReason: func(reason error) {
 				// current node lost the lease lock and be slave node
-				// we can do cleanup here
-				klog.Infof("lost: lease-lock-id")
+				// we can do cleanup here, or use RunForever to campaign again
+				// instead of restarting the process
+				klog.Infof("lost: lease-lock-id: %v", reason)
 				os.Exit(0)
 			},
 			OnNewLeader: func(identity string) {
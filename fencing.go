@@ -0,0 +1,60 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"context"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+)
+
+// A fencing token identifies a leadership term. Tokens increase
+// monotonically from one term to the next, so that systems guarded by the
+// lease can reject writes carrying a token older than the newest they have
+// seen, e.g. from a leader that was paused past its lease expiry.
+
+type fencingTokenKey struct{}
+
+// withFencingToken returns a copy of ctx carrying the fencing token.
+func withFencingToken(ctx context.Context, token int64) context.Context {
+	return context.WithValue(ctx, fencingTokenKey{}, token)
+}
+
+// FencingTokenFromContext returns the fencing token of the leadership term
+// carried by the context passed to OnStartedLeading.
+func FencingTokenFromContext(ctx context.Context) (int64, bool) {
+	token, ok := ctx.Value(fencingTokenKey{}).(int64)
+	return token, ok
+}
+
+// FencingToken returns the fencing token of the current leadership term, or
+// zero if this client is not the leader.
+func (le *LeaderElector) FencingToken() int64 {
+	if !le.IsLeader() {
+		return 0
+	}
+	return le.fencingToken.Load()
+}
+
+// newFencingToken derives the fencing token of a term that was just
+// acquired. Locks implementing resourcelock.Revisioner provide the revision
+// of the winning write, other locks fall back to the transitions count of
+// the record.
+func (le *LeaderElector) newFencingToken() int64 {
+	if revisioner, ok := le.config.Lock.(rl.Revisioner); ok {
+		return revisioner.Revision()
+	}
+	return int64(le.getObservedRecord().LeaderTransitions)
+}
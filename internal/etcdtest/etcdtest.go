@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+// Package etcdtest runs an in-process etcd server for tests.
+package etcdtest
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// Server is an in-process etcd server.
+type Server struct {
+	// Endpoint is the client URL of the server.
+	Endpoint string
+
+	etcd *embed.Etcd
+	dir  string
+}
+
+// Start starts a single-member etcd server on free local ports.
+func Start() (*Server, error) {
+	dir, err := os.MkdirTemp("", "etcdtest")
+	if err != nil {
+		return nil, err
+	}
+	clientURL, err := freeURL()
+	if err != nil {
+		return nil, err
+	}
+	peerURL, err := freeURL()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	etcd, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		etcd.Close()
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("etcd server did not become ready")
+	}
+	return &Server{Endpoint: clientURL.String(), etcd: etcd, dir: dir}, nil
+}
+
+// Close stops the server and removes its data.
+func (s *Server) Close() {
+	s.etcd.Close()
+	os.RemoveAll(s.dir)
+}
+
+// NewClient returns a client of the server, closed when the test ends.
+func (s *Server) NewClient(t testing.TB) *clientv3.Client {
+	t.Helper()
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{s.Endpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("error creating etcd client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// freeURL returns a URL on a free local port.
+func freeURL() (*url.URL, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	return url.Parse("http://" + l.Addr().String())
+}
@@ -17,12 +17,15 @@ package leaderelection
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	rl "github.com/khh403/leaderelection/resourcelock"
-	"k8s.io/apimachinery/pkg/api/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -34,6 +37,31 @@ const (
 	JitterFactor = 1.2
 )
 
+var (
+	// ErrContextCancelled is returned by RunE when the context it was run
+	// with is done. It wraps the error of the context.
+	ErrContextCancelled = errors.New("leader election context cancelled")
+	// ErrLeadershipLost is returned by RunE when another candidate took over
+	// the lease, or won the race to update it.
+	ErrLeadershipLost = errors.New("leadership lost to another candidate")
+	// ErrRenewDeadlineExceeded is returned by RunE when the lease could not be
+	// renewed within RenewDeadline. It wraps the last error returned by the
+	// lock, if any.
+	ErrRenewDeadlineExceeded = errors.New("failed to renew lease within renew deadline")
+	// ErrLeadershipTransferred is returned by RunE when leadership was handed
+	// over to another candidate with TransferTo.
+	ErrLeadershipTransferred = errors.New("leadership transferred to another candidate")
+	// ErrNotLeader is returned by TransferTo when the client is not leading.
+	ErrNotLeader = errors.New("not the leader")
+
+	// errLeaseHeld is returned by tryAcquireOrRenew when the lease is validly
+	// held by another candidate.
+	errLeaseHeld = errors.New("lease is held by another candidate")
+	// errYield is returned by tryAcquireOrRenew when the leader stopped its
+	// term to hand over the lease to the candidate asking for it.
+	errYield = errors.New("lease is yielded to another candidate")
+)
+
 // NewLeaderElector creates a LeaderElector from a LeaderElectionConfig
 // 根据 leader election 配置 LeaderElectionConfig 实例话一个选举其 LeaderElector
 func NewLeaderElector(lec LeaderElectionConfig) (*LeaderElector, error) {
@@ -55,21 +83,33 @@ func NewLeaderElector(lec LeaderElectionConfig) (*LeaderElector, error) {
 	if lec.Callbacks.OnStartedLeading == nil {
 		return nil, fmt.Errorf("OnStartedLeading callback must not be nil")
 	}
-	if lec.Callbacks.OnStoppedLeading == nil {
-		return nil, fmt.Errorf("OnStoppedLeading callback must not be nil")
+	if lec.Callbacks.OnStoppedLeading == nil && lec.Callbacks.OnStoppedLeadingWithReason == nil {
+		return nil, fmt.Errorf("OnStoppedLeading or OnStoppedLeadingWithReason callback must not be nil")
 	}
 
 	if lec.Lock == nil {
 		return nil, fmt.Errorf("Lock must not be nil.")
 	}
+	if lec.Coordinated {
+		if _, ok := lec.Lock.(rl.CandidateRegistry); !ok {
+			return nil, fmt.Errorf("Lock must implement resourcelock.CandidateRegistry in coordinated mode")
+		}
+		if lec.Strategy == nil {
+			lec.Strategy = NewestVersionStrategy{}
+		}
+	}
 	id := lec.Lock.Identity()
 	if id == "" {
 		return nil, fmt.Errorf("Lock identity is empty")
 	}
 
+	if lec.Clock == nil {
+		lec.Clock = clock.RealClock{}
+	}
+
 	le := LeaderElector{
 		config:  lec,
-		clock:   clock.RealClock{},
+		clock:   lec.Clock,
 		metrics: globalMetricsFactory.newLeaderMetrics(),
 	}
 	le.metrics.leaderOff(le.config.Name)
@@ -126,6 +166,27 @@ type LeaderElectionConfig struct {
 
 	// Name is the name of the resource lock for debugging
 	Name string
+
+	// Preempt makes this client ask a leader with a lower priority to hand
+	// over leadership, instead of waiting for the lease to be released or
+	// to expire. Priorities are only known for locks implementing
+	// resourcelock.CandidateRegistry.
+	Preempt bool
+
+	// Coordinated lets the Strategy, rather than a race between candidates,
+	// decide who leads. The Lock must implement
+	// resourcelock.CandidateRegistry.
+	Coordinated bool
+	// Strategy picks the leader in coordinated mode. It defaults to
+	// NewestVersionStrategy.
+	Strategy Strategy
+
+	// Clock is used to observe lease expiry. It defaults to the real clock
+	// and may be replaced by a fake clock in tests. Only the lease expiry
+	// checks, the timestamps of the record and the waits for an observed
+	// lease to expire follow it; the RetryPeriod and RenewDeadline loops
+	// always run on real time.
+	Clock clock.Clock
 }
 
 // LeaderCallbacks are callbacks that are triggered during certain
@@ -138,6 +199,9 @@ type LeaderCallbacks struct {
 	OnStartedLeading func(context.Context)
 	// OnStoppedLeading is called when a LeaderElector client stops leading
 	OnStoppedLeading func()
+	// OnStoppedLeadingWithReason is called along with OnStoppedLeading and
+	// receives the reason the client stopped leading, as returned by RunE.
+	OnStoppedLeadingWithReason func(reason error)
 	// OnNewLeader is called when the client observes a leader that is
 	// not the previously observed leader. This includes the first observed
 	// leader when the client starts.
@@ -164,6 +228,18 @@ type LeaderElector struct {
 	observedRecordLock sync.Mutex
 
 	metrics leaderMetricsAdapter
+
+	// fencingToken of the current or last leadership term
+	fencingToken atomic.Int64
+	// slot of the lock held in the current or last leadership term
+	slot atomic.Int64
+
+	// termLock protects stopTerm and transfer
+	termLock sync.Mutex
+	// stopTerm stops renewing the lease of the current term, nil if not leading
+	stopTerm context.CancelFunc
+	// transfer is the pending leadership transfer of the current term
+	transfer *transferRequest
 }
 
 // Run starts the leader election loop. Run will not return
@@ -171,16 +247,129 @@ type LeaderElector struct {
 // stopped holding the leader lease
 // 启动选举调用函数Run(ctx context.Context)
 func (le *LeaderElector) Run(ctx context.Context) {
+	_ = le.RunE(ctx)
+}
+
+// RunE starts the leader election loop like Run and returns the reason it
+// stopped: ErrContextCancelled if ctx is done, ErrLeadershipLost if another
+// candidate took over the lease, or ErrRenewDeadlineExceeded wrapping the
+// last error of the lock if the lease could not be renewed in time.
+func (le *LeaderElector) RunE(ctx context.Context) (err error) {
 	defer runtime.HandleCrash()
-	defer le.config.Callbacks.OnStoppedLeading()
+	defer func() { le.stoppedLeading(err) }()
 
+	le.registerCandidate(ctx)
 	if !le.acquire(ctx) {
-		return // ctx signalled done
+		return contextDone(ctx) // ctx signalled done
 	}
-	ctx, cancel := context.WithCancel(ctx)
+	_, err = le.lead(ctx)
+	return err
+}
+
+// RunForever starts the leader election loop like Run, but instead of
+// returning once it stopped holding the leader lease, it campaigns for the
+// lease again after a backoff. Each term ends by cancelling the context passed
+// to OnStartedLeading, waiting for OnStartedLeading to return and calling
+// OnStoppedLeading, before the next campaign starts. RunForever returns when
+// ctx is done.
+func (le *LeaderElector) RunForever(ctx context.Context) {
+	defer runtime.HandleCrash()
+
+	le.registerCandidate(ctx)
+	backoff := le.newCampaignBackoff()
+	for le.acquire(ctx) {
+		started := le.clock.Now()
+		done, reason := le.lead(ctx)
+		<-done
+		le.stoppedLeading(reason)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// a term that outlived its lease was not a flapping one
+		if le.clock.Since(started) > le.config.LeaseDuration {
+			backoff = le.newCampaignBackoff()
+		}
+		delay := backoff.Step()
+		klog.Infof("campaigning for lease %v again in %v: %v", le.config.Lock.Describe(), delay, reason)
+		select {
+		case <-ctx.Done():
+			return
+		case <-le.clock.After(delay):
+		}
+	}
+}
+
+// lead runs OnStartedLeading and renews the lease until it is lost or ctx
+// signals done, then cancels the context passed to OnStartedLeading. It
+// returns the reason the lease was lost and a channel that is closed once
+// OnStartedLeading returned.
+func (le *LeaderElector) lead(ctx context.Context) (<-chan struct{}, error) {
+	leaderCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	go le.config.Callbacks.OnStartedLeading(ctx)
-	le.renew(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		le.config.Callbacks.OnStartedLeading(le.leaderContext(leaderCtx))
+	}()
+	reason := le.renew(ctx)
+	// the term ended, whether the lease was lost, handed over or ctx is done
+	le.metrics.leaderOff(le.config.Name)
+	cancel()
+	if transfer := le.endTerm(); transfer != nil {
+		// the successor must not lead before this client stopped leading
+		<-done
+		err := le.handOver(transfer.identity)
+		transfer.done <- err
+		if err == nil {
+			return done, ErrLeadershipTransferred
+		}
+		klog.Errorf("Failed to transfer leadership to %v: %v", transfer.identity, err)
+		if reason == nil {
+			reason = fmt.Errorf("failed to transfer leadership to %v: %w", transfer.identity, err)
+		}
+	}
+	if reason == nil {
+		reason = contextDone(ctx)
+	}
+
+	// if we hold the lease, give it up
+	if le.config.ReleaseOnCancel {
+		le.release()
+	}
+	return done, reason
+}
+
+// leaderContext returns a copy of ctx carrying the fencing token of the
+// current term and the index of the held slot, if any.
+func (le *LeaderElector) leaderContext(ctx context.Context) context.Context {
+	ctx = withFencingToken(ctx, le.fencingToken.Load())
+	if _, ok := le.config.Lock.(rl.Slotter); ok {
+		ctx = withSlot(ctx, int(le.slot.Load()))
+	}
+	return ctx
+}
+
+// stoppedLeading invokes the OnStoppedLeading callbacks.
+func (le *LeaderElector) stoppedLeading(reason error) {
+	if le.config.Callbacks.OnStoppedLeading != nil {
+		le.config.Callbacks.OnStoppedLeading()
+	}
+	if le.config.Callbacks.OnStoppedLeadingWithReason != nil {
+		le.config.Callbacks.OnStoppedLeadingWithReason(reason)
+	}
+}
+
+// newCampaignBackoff returns the backoff applied by RunForever between losing
+// the lease and campaigning again.
+func (le *LeaderElector) newCampaignBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: le.config.RetryPeriod,
+		Factor:   2,
+		Jitter:   JitterFactor,
+		Steps:    math.MaxInt32,
+		Cap:      le.config.LeaseDuration,
+	}
 }
 
 // RunOrDie starts a client with the provided config or panics if the config
@@ -211,6 +400,9 @@ func (le *LeaderElector) IsLeader() bool {
 
 // acquire loops calling tryAcquireOrRenew and returns true immediately when tryAcquireOrRenew succeeds.
 // Returns false if ctx signals done.
+// If the lock implements resourcelock.Watcher, attempts are driven by changes of the record
+// instead of polling every RetryPeriod. When the watch breaks, the record is polled once
+// after RetryPeriod and watched again.
 // 执行选举
 func (le *LeaderElector) acquire(ctx context.Context) bool {
 	ctx, cancel := context.WithCancel(ctx)
@@ -218,31 +410,134 @@ func (le *LeaderElector) acquire(ctx context.Context) bool {
 	succeeded := false
 	desc := le.config.Lock.Describe()
 	klog.Infof("attempting to acquire leader lease %v ...", desc)
+	if watcher, ok := le.config.Lock.(rl.Watcher); ok {
+		for {
+			// acquireWatching polls the record before watching it
+			if le.acquireWatching(ctx, watcher) {
+				return true
+			}
+			if ctx.Err() != nil {
+				return false
+			}
+			klog.Infof("watch on lease %v broke, polling before watching it again", desc)
+			timer := time.NewTimer(wait.Jitter(le.config.RetryPeriod, JitterFactor))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return false
+			case <-timer.C:
+			}
+		}
+	}
 	wait.JitterUntil(func() {
-		succeeded = le.tryAcquireOrRenew(ctx)
-		le.maybeReportTransition()
-		if !succeeded {
-			klog.Infof("failed to acquire lease %v", desc)
-			return
+		succeeded = le.tryAcquire(ctx)
+		if succeeded {
+			cancel()
 		}
-		le.config.Lock.RecordEvent("became leader")
-		le.metrics.leaderOn(le.config.Name)
-		klog.Infof("successfully acquired lease %v", desc)
-		cancel()
 	}, le.config.RetryPeriod, JitterFactor, true, ctx.Done())
 	return succeeded
 }
 
+// acquireWatching calls tryAcquire whenever the watched record may have become
+// acquirable. It returns true once the lease is acquired, and false if ctx
+// signals done or the watch broke.
+func (le *LeaderElector) acquireWatching(ctx context.Context, watcher rl.Watcher) bool {
+	var events <-chan rl.WatchEvent
+	for {
+		if le.tryAcquire(ctx) {
+			return true
+		}
+		if events == nil {
+			// watch from the record read by tryAcquire on
+			events = watcher.Watch(ctx)
+		}
+		if !le.waitForVacancy(ctx, events) {
+			return false
+		}
+	}
+}
+
+// waitForVacancy blocks until the watched record is released or deleted, or the
+// observed lease expires. Records seen on the watch are observed as if returned
+// by Get. Returns false if ctx signals done or the watch broke.
+func (le *LeaderElector) waitForVacancy(ctx context.Context, events <-chan rl.WatchEvent) bool {
+	timer := le.clock.NewTimer(le.untilLeaseExpiry())
+	defer func() { timer.Stop() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C():
+			return true
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			if event.Record == nil || (len(event.Record.HolderIdentity) == 0 && le.isPreferredHolder(event.Record)) {
+				return true
+			}
+			if !bytes.Equal(le.observedRawRecord, event.RawRecord) {
+				le.setObservedRecord(event.Record)
+				le.observedRawRecord = event.RawRecord
+				le.maybeReportTransition()
+
+				timer.Stop()
+				timer = le.clock.NewTimer(le.untilLeaseExpiry())
+			}
+		}
+	}
+}
+
+// tryAcquire makes a single attempt to acquire the lease and returns true on success.
+func (le *LeaderElector) tryAcquire(ctx context.Context) bool {
+	desc := le.config.Lock.Describe()
+	le.metrics.acquireAttempt(le.config.Name)
+	err := le.tryAcquireOrRenew(ctx)
+	le.maybeReportTransition()
+	if err != nil {
+		klog.Infof("failed to acquire lease %v", desc)
+		return false
+	}
+	le.fencingToken.Store(le.newFencingToken())
+	le.slot.Store(int64(le.newSlot()))
+	le.config.Lock.RecordEvent("became leader")
+	le.metrics.leaderOn(le.config.Name)
+	klog.Infof("successfully acquired lease %v", desc)
+	return true
+}
+
 // renew loops calling tryAcquireOrRenew and returns immediately when tryAcquireOrRenew fails or ctx signals done.
-func (le *LeaderElector) renew(ctx context.Context) {
+// It returns the reason the lease was lost, or nil if ctx signalled done or
+// the term was stopped.
+func (le *LeaderElector) renew(ctx context.Context) error {
 	defer le.config.Lock.RecordEvent("stopped leading")
+	parent := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	le.startTerm(cancel)
+	var reason error
 	wait.Until(func() {
 		timeoutCtx, timeoutCancel := context.WithTimeout(ctx, le.config.RenewDeadline)
 		defer timeoutCancel()
+		var lastErr error
 		err := wait.PollImmediateUntil(le.config.RetryPeriod, func() (bool, error) {
-			return le.tryAcquireOrRenew(timeoutCtx), nil
+			start := le.clock.Now()
+			lastErr = le.tryAcquireOrRenew(timeoutCtx)
+			if errors.Is(lastErr, errLeaseHeld) {
+				// no point in retrying, someone else is leading now
+				return false, ErrLeadershipLost
+			}
+			if errors.Is(lastErr, errYield) {
+				// the term was stopped to hand over the lease, see lead
+				return false, errYield
+			}
+			if lastErr != nil {
+				return false, nil
+			}
+			le.metrics.renewLatency(le.config.Name, le.clock.Since(start))
+			le.metrics.leaseAge(le.config.Name, le.clock.Since(le.getObservedRecord().AcquireTime.Time))
+			le.maybeHandOver(timeoutCtx)
+			return true, nil
 		}, timeoutCtx.Done())
 
 		le.maybeReportTransition()
@@ -251,17 +546,37 @@ func (le *LeaderElector) renew(ctx context.Context) {
 			klog.V(5).Infof("successfully renewed lease %v", desc)
 			return
 		}
-		le.metrics.leaderOff(le.config.Name)
+		if errors.Is(err, errYield) {
+			return
+		}
+		le.metrics.renewFailed(le.config.Name)
 		klog.Infof("failed to renew lease %v: %v", desc, err)
+		reason = renewFailure(parent, lastErr)
 		cancel()
 	}, le.config.RetryPeriod, ctx.Done())
+	return reason
+}
 
-	// if we hold the lease, give it up
-	if le.config.ReleaseOnCancel {
-		le.release()
+// renewFailure classifies the error of the last renewal attempt before the
+// lease was lost.
+func renewFailure(ctx context.Context, lastErr error) error {
+	switch {
+	case ctx.Err() != nil:
+		return contextDone(ctx)
+	case errors.Is(lastErr, errLeaseHeld), rl.IsConflict(lastErr):
+		return ErrLeadershipLost
+	case lastErr != nil:
+		return fmt.Errorf("%w: %w", ErrRenewDeadlineExceeded, lastErr)
+	default:
+		return ErrRenewDeadlineExceeded
 	}
 }
 
+// contextDone returns ErrContextCancelled wrapping the error of ctx.
+func contextDone(ctx context.Context) error {
+	return fmt.Errorf("%w: %w", ErrContextCancelled, ctx.Err())
+}
+
 // release attempts to release the leader lease if we have acquired it.
 func (le *LeaderElector) release() bool {
 	if !le.IsLeader() {
@@ -274,7 +589,20 @@ func (le *LeaderElector) release() bool {
 		RenewTime:            now,
 		AcquireTime:          now,
 	}
-	if err := le.config.Lock.Update(context.TODO(), leaderElectionRecord); err != nil {
+	err := le.config.Lock.Update(context.TODO(), leaderElectionRecord)
+	if rl.IsConflict(err) {
+		// a renewal interrupted by the cancellation may have been stored
+		// anyway, leaving the lock behind the record. Release the record
+		// read back, if it is still ours.
+		var record *rl.LeaderElectionRecord
+		if record, _, err = le.config.Lock.Get(context.TODO()); err == nil {
+			if record.HolderIdentity != le.config.Lock.Identity() {
+				return true
+			}
+			err = le.config.Lock.Update(context.TODO(), leaderElectionRecord)
+		}
+	}
+	if err != nil {
 		klog.Errorf("Failed to release lock: %v", err)
 		return false
 	}
@@ -284,15 +612,18 @@ func (le *LeaderElector) release() bool {
 }
 
 // tryAcquireOrRenew tries to acquire a leader lease if it is not already acquired,
-// else it tries to renew the lease if it has already been acquired. Returns true
-// on success else returns false.
-func (le *LeaderElector) tryAcquireOrRenew(ctx context.Context) bool {
+// else it tries to renew the lease if it has already been acquired. Returns nil
+// on success, errLeaseHeld if the lease is held by another candidate, errYield
+// if the leader yields it to another candidate, and the error of the lock
+// otherwise.
+func (le *LeaderElector) tryAcquireOrRenew(ctx context.Context) error {
 	now := metav1.NewTime(le.clock.Now())
 	leaderElectionRecord := rl.LeaderElectionRecord{
 		HolderIdentity:       le.config.Lock.Identity(),
 		LeaseDurationSeconds: int(le.config.LeaseDuration / time.Second),
 		RenewTime:            now,
 		AcquireTime:          now,
+		HolderMetadata:       le.advertisedMetadata(),
 	}
 
 	// 1. fast path for the leader to update optimistically assuming that the record observed
@@ -305,7 +636,7 @@ func (le *LeaderElector) tryAcquireOrRenew(ctx context.Context) bool {
 		err := le.config.Lock.Update(ctx, leaderElectionRecord)
 		if err == nil {
 			le.setObservedRecord(&leaderElectionRecord)
-			return true
+			return nil
 		}
 		klog.Errorf("Failed to update lock optimitically: %v, falling back to slow path", err)
 	}
@@ -313,19 +644,25 @@ func (le *LeaderElector) tryAcquireOrRenew(ctx context.Context) bool {
 	// 2. obtain or create the ElectionRecord
 	oldLeaderElectionRecord, oldLeaderElectionRawRecord, err := le.config.Lock.Get(ctx)
 	if err != nil {
-		fmt.Printf("==== error: %s\n", err.Error())
-		if !errors.IsNotFound(err) {
+		if !apierrors.IsNotFound(err) {
 			klog.Errorf("error retrieving resource lock %v: %v", le.config.Lock.Describe(), err)
-			return false
+			return fmt.Errorf("error retrieving resource lock %v: %w", le.config.Lock.Describe(), err)
+		}
+		if err = le.mayAcquire(ctx); err != nil {
+			return err
 		}
 		if err = le.config.Lock.Create(ctx, leaderElectionRecord); err != nil {
+			if rl.IsConflict(err) {
+				klog.V(4).Infof("lost the race to create leader election record %v", le.config.Lock.Describe())
+				return err
+			}
 			klog.Errorf("error initially creating leader election record: %v", err)
-			return false
+			return fmt.Errorf("error initially creating leader election record: %w", err)
 		}
 
 		le.setObservedRecord(&leaderElectionRecord)
 
-		return true
+		return nil
 	}
 
 	// 3. Record obtained, check the Identity & Time
@@ -336,7 +673,23 @@ func (le *LeaderElector) tryAcquireOrRenew(ctx context.Context) bool {
 	}
 	if len(oldLeaderElectionRecord.HolderIdentity) > 0 && le.isLeaseValid(now.Time) && !le.IsLeader() {
 		klog.V(4).Infof("lock is held by %v and has not yet expired", oldLeaderElectionRecord.HolderIdentity)
-		return false
+		le.requestYield(ctx, oldLeaderElectionRecord)
+		return errLeaseHeld
+	}
+	if !le.isPreferredHolder(oldLeaderElectionRecord) && le.isLeaseValid(now.Time) && !le.IsLeader() {
+		klog.V(4).Infof("lock is handed over to %v and has not yet expired", oldLeaderElectionRecord.PreferredHolder)
+		return errLeaseHeld
+	}
+
+	if le.IsLeader() && le.yieldRequested(ctx, oldLeaderElectionRecord) {
+		klog.Infof("yielding lease %v to %v", le.config.Lock.Describe(), oldLeaderElectionRecord.PreferredHolder)
+		le.requestTransfer(oldLeaderElectionRecord.PreferredHolder)
+		return errYield
+	}
+	if !le.IsLeader() && oldLeaderElectionRecord.PreferredHolder != le.config.Lock.Identity() {
+		if err = le.mayAcquire(ctx); err != nil {
+			return err
+		}
 	}
 
 	// 4. We're going to try to update. The leaderElectionRecord is set to it's default
@@ -351,12 +704,16 @@ func (le *LeaderElector) tryAcquireOrRenew(ctx context.Context) bool {
 
 	// update the lock itself
 	if err = le.config.Lock.Update(ctx, leaderElectionRecord); err != nil {
+		if rl.IsConflict(err) {
+			klog.V(4).Infof("lost the race to update lock %v", le.config.Lock.Describe())
+			return err
+		}
 		klog.Errorf("Failed to update lock: %v", err)
-		return false
+		return fmt.Errorf("failed to update lock: %w", err)
 	}
 
 	le.setObservedRecord(&leaderElectionRecord)
-	return true
+	return nil
 }
 
 func (le *LeaderElector) maybeReportTransition() {
@@ -364,6 +721,7 @@ func (le *LeaderElector) maybeReportTransition() {
 		return
 	}
 	le.reportedLeader = le.observedRecord.HolderIdentity
+	le.metrics.transition(le.config.Name)
 	if le.config.Callbacks.OnNewLeader != nil {
 		go le.config.Callbacks.OnNewLeader(le.reportedLeader)
 	}
@@ -385,8 +743,21 @@ func (le *LeaderElector) Check(maxTolerableExpiredLease time.Duration) error {
 	return nil
 }
 
+// untilLeaseExpiry returns how long the observed lease remains valid, but at
+// least a jittered RetryPeriod.
+func (le *LeaderElector) untilLeaseExpiry() time.Duration {
+	leaseDuration := time.Second * time.Duration(le.getObservedRecord().LeaseDurationSeconds)
+	remaining := le.observedTime.Add(leaseDuration).Sub(le.clock.Now())
+	if minimum := wait.Jitter(le.config.RetryPeriod, JitterFactor); remaining < minimum {
+		return minimum
+	}
+	return remaining
+}
+
 func (le *LeaderElector) isLeaseValid(now time.Time) bool {
-	return le.observedTime.Add(time.Second * time.Duration(le.getObservedRecord().LeaseDurationSeconds)).After(now)
+	le.observedRecordLock.Lock()
+	defer le.observedRecordLock.Unlock()
+	return le.observedTime.Add(time.Second * time.Duration(le.observedRecord.LeaseDurationSeconds)).After(now)
 }
 
 // setObservedRecord will set a new observedRecord and update observedTime to the current time.
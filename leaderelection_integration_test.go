@@ -0,0 +1,329 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection_test
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/khh403/leaderelection"
+	"github.com/khh403/leaderelection/internal/etcdtest"
+	rl "github.com/khh403/leaderelection/resourcelock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	testLeaseDuration = 2 * time.Second
+	testRenewDeadline = time.Second
+	testRetryPeriod   = 100 * time.Millisecond
+)
+
+// etcdServer is shared by the integration tests, nil with -short.
+var etcdServer *etcdtest.Server
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Short() {
+		var err error
+		etcdServer, err = etcdtest.Start()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error starting etcd: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	code := m.Run()
+	if etcdServer != nil {
+		etcdServer.Close()
+	}
+	os.Exit(code)
+}
+
+// candidate runs a LeaderElector against the LeaseLock of a test.
+type candidate struct {
+	id     string
+	le     *leaderelection.LeaderElector
+	cancel context.CancelFunc
+	result chan error
+
+	mu      sync.Mutex
+	leaders []string
+}
+
+func newClient(t *testing.T) *clientv3.Client {
+	t.Helper()
+	if etcdServer == nil {
+		t.Skip("skipping etcd integration test in short mode")
+	}
+	client := etcdServer.NewClient(t)
+	// runs after the candidates of the test stopped
+	t.Cleanup(func() {
+		client.Delete(context.Background(), "/integration/"+t.Name())
+	})
+	return client
+}
+
+// startCandidate starts a candidate for the lock named after the test.
+func startCandidate(t *testing.T, client *clientv3.Client, id string, releaseOnCancel bool) *candidate {
+	t.Helper()
+	c := &candidate{id: id, result: make(chan error, 1)}
+	lock := &rl.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: "/integration", Name: t.Name()},
+		Client:     client,
+		LockConfig: rl.ResourceLockConfig{Identity: id},
+	}
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   testLeaseDuration,
+		RenewDeadline:   testRenewDeadline,
+		RetryPeriod:     testRetryPeriod,
+		ReleaseOnCancel: releaseOnCancel,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {},
+			OnStoppedLeading: func() {},
+			OnNewLeader: func(identity string) {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				c.leaders = append(c.leaders, identity)
+			},
+		},
+		Name: id,
+	})
+	if err != nil {
+		t.Fatalf("error creating elector %v: %v", id, err)
+	}
+	c.le = le
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go func() { c.result <- le.RunE(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-c.result
+	})
+	return c
+}
+
+// stop stops the candidate and returns the error returned by RunE.
+func (c *candidate) stop(t *testing.T) error {
+	t.Helper()
+	c.cancel()
+	return c.wait(t)
+}
+
+// wait waits for RunE to return, and puts the error back for the cleanup.
+func (c *candidate) wait(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-c.result:
+		c.result <- err
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%v did not stop", c.id)
+		return nil
+	}
+}
+
+// observedLeaders returns the non-empty leaders reported to OnNewLeader.
+func (c *candidate) observedLeaders() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var leaders []string
+	for _, leader := range c.leaders {
+		if leader != "" {
+			leaders = append(leaders, leader)
+		}
+	}
+	return leaders
+}
+
+// waitForLeader waits until one of candidates leads and returns it.
+func waitForLeader(t *testing.T, candidates ...*candidate) *candidate {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, c := range candidates {
+			if c.le.IsLeader() {
+				return c
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no candidate acquired the lease")
+	return nil
+}
+
+// others returns candidates without c.
+func others(c *candidate, candidates []*candidate) []*candidate {
+	var rest []*candidate
+	for _, other := range candidates {
+		if other != c {
+			rest = append(rest, other)
+		}
+	}
+	return rest
+}
+
+// getRecord reads the record of the lock named after the test.
+func getRecord(t *testing.T, client *clientv3.Client) *rl.LeaderElectionRecord {
+	t.Helper()
+	lock := &rl.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{Namespace: "/integration", Name: t.Name()},
+		Client:    client,
+	}
+	record, _, err := lock.Get(context.Background())
+	if err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	return record
+}
+
+func TestIntegrationAcquisition(t *testing.T) {
+	client := newClient(t)
+	var candidates []*candidate
+	for _, id := range []string{"a", "b", "c"} {
+		candidates = append(candidates, startCandidate(t, client, id, true))
+	}
+	leader := waitForLeader(t, candidates...)
+	time.Sleep(5 * testRetryPeriod)
+
+	for _, c := range candidates {
+		if c != leader && c.le.IsLeader() {
+			t.Errorf("both %v and %v lead", leader.id, c.id)
+		}
+		if got := c.le.GetLeader(); got != leader.id {
+			t.Errorf("%v observes leader %q, want %q", c.id, got, leader.id)
+		}
+	}
+	if got := getRecord(t, client).HolderIdentity; got != leader.id {
+		t.Errorf("record is held by %q, want %q", got, leader.id)
+	}
+}
+
+func TestIntegrationRenewal(t *testing.T) {
+	client := newClient(t)
+	candidates := []*candidate{
+		startCandidate(t, client, "a", true),
+		startCandidate(t, client, "b", true),
+	}
+	leader := waitForLeader(t, candidates...)
+	acquired := getRecord(t, client)
+
+	// outlive the lease, which must be renewed by the leader meanwhile
+	time.Sleep(testLeaseDuration + time.Second)
+	record := getRecord(t, client)
+	if record.HolderIdentity != leader.id || !leader.le.IsLeader() {
+		t.Fatalf("%v lost the lease to %q", leader.id, record.HolderIdentity)
+	}
+	if !record.RenewTime.After(acquired.RenewTime.Time) {
+		t.Errorf("lease was not renewed, renew time %v", record.RenewTime)
+	}
+	if !record.AcquireTime.Equal(&acquired.AcquireTime) || record.LeaderTransitions != acquired.LeaderTransitions {
+		t.Errorf("renewal changed the term: %+v, was %+v", record, acquired)
+	}
+	for _, c := range others(leader, candidates) {
+		if c.le.IsLeader() {
+			t.Errorf("%v leads while %v renews", c.id, leader.id)
+		}
+	}
+}
+
+func TestIntegrationReleaseOnCancel(t *testing.T) {
+	client := newClient(t)
+	candidates := []*candidate{
+		startCandidate(t, client, "a", true),
+		startCandidate(t, client, "b", true),
+		startCandidate(t, client, "c", true),
+	}
+	leader := waitForLeader(t, candidates...)
+
+	start := time.Now()
+	if err := leader.stop(t); !errors.Is(err, leaderelection.ErrContextCancelled) {
+		t.Errorf("expected ErrContextCancelled, got %v", err)
+	}
+	next := waitForLeader(t, others(leader, candidates)...)
+	// the followers watch the record, so they do not wait for the lease to expire
+	if elapsed := time.Since(start); elapsed >= testLeaseDuration {
+		t.Errorf("%v took over after %v, the released lease was not picked up", next.id, elapsed)
+	}
+}
+
+func TestIntegrationLeaderCrashFailover(t *testing.T) {
+	client := newClient(t)
+	candidates := []*candidate{
+		startCandidate(t, client, "a", false),
+		startCandidate(t, client, "b", false),
+	}
+	leader := waitForLeader(t, candidates...)
+
+	// stopping without releasing leaves the record behind, like a crash
+	start := time.Now()
+	leader.stop(t)
+	next := waitForLeader(t, others(leader, candidates)...)
+	if elapsed := time.Since(start); elapsed < testLeaseDuration/2 {
+		t.Errorf("%v took over after %v, before the lease of %v expired", next.id, elapsed, leader.id)
+	}
+	record := getRecord(t, client)
+	if record.HolderIdentity != next.id || record.LeaderTransitions != 1 {
+		t.Errorf("expected %v to hold the lease after one transition, got %+v", next.id, record)
+	}
+}
+
+func TestIntegrationClosedClient(t *testing.T) {
+	client := newClient(t)
+	leaderClient := newClient(t)
+	a := startCandidate(t, leaderClient, "a", false)
+	waitForLeader(t, a)
+	b := startCandidate(t, client, "b", false)
+	time.Sleep(5 * testRetryPeriod)
+
+	// the leader loses its connection to etcd
+	leaderClient.Close()
+	if err := a.wait(t); !errors.Is(err, leaderelection.ErrRenewDeadlineExceeded) {
+		t.Errorf("expected ErrRenewDeadlineExceeded, got %v", err)
+	}
+	waitForLeader(t, b)
+}
+
+func TestIntegrationOnNewLeaderOrder(t *testing.T) {
+	client := newClient(t)
+	candidates := []*candidate{
+		startCandidate(t, client, "a", true),
+		startCandidate(t, client, "b", true),
+		startCandidate(t, client, "c", true),
+	}
+	first := waitForLeader(t, candidates...)
+	time.Sleep(5 * testRetryPeriod)
+	first.stop(t)
+	rest := others(first, candidates)
+	second := waitForLeader(t, rest...)
+	time.Sleep(5 * testRetryPeriod)
+
+	want := []string{first.id, second.id}
+	for _, c := range rest {
+		if got := c.observedLeaders(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v observed leaders %v, want %v", c.id, got, want)
+		}
+	}
+	if got := first.observedLeaders(); !reflect.DeepEqual(got, []string{first.id}) {
+		t.Errorf("%v observed leaders %v, want %v", first.id, got, []string{first.id})
+	}
+}
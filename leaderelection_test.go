@@ -0,0 +1,491 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+	"github.com/khh403/leaderelection/resourcelock/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// racingLock runs afterGet once after its next Get, to let another candidate
+// write the record between the Get and the write of tryAcquireOrRenew.
+type racingLock struct {
+	*fake.Lock
+	afterGet func()
+}
+
+func (l *racingLock) Get(ctx context.Context) (*rl.LeaderElectionRecord, []byte, error) {
+	record, raw, err := l.Lock.Get(ctx)
+	if f := l.afterGet; f != nil {
+		l.afterGet = nil
+		f()
+	}
+	return record, raw, err
+}
+
+func newTestElector(t *testing.T, lock rl.Interface, clock *clocktesting.FakeClock) *LeaderElector {
+	t.Helper()
+	le, err := NewLeaderElector(LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: 10 * time.Second,
+		RenewDeadline: 200 * time.Millisecond,
+		RetryPeriod:   20 * time.Millisecond,
+		Callbacks: LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {},
+			OnStoppedLeading: func() {},
+		},
+		Clock: clock,
+		Name:  lock.Identity(),
+	})
+	if err != nil {
+		t.Fatalf("error creating elector: %v", err)
+	}
+	return le
+}
+
+func TestTryAcquireOrRenewLosesCreateRace(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	a := &racingLock{Lock: fake.NewLock(store, "a")}
+	leA := newTestElector(t, a, clock)
+	leB := newTestElector(t, fake.NewLock(store, "b"), clock)
+
+	a.afterGet = func() {
+		if err := leB.tryAcquireOrRenew(context.Background()); err != nil {
+			t.Fatalf("b failed to acquire: %v", err)
+		}
+	}
+	err := leA.tryAcquireOrRenew(context.Background())
+	if !rl.IsConflict(err) {
+		t.Fatalf("expected a to lose the race with ErrConflict, got %v", err)
+	}
+	if leA.IsLeader() {
+		t.Errorf("a must not believe it is leader after losing the race")
+	}
+	if got := store.Record().HolderIdentity; got != "b" {
+		t.Errorf("expected b to hold the lease, got %q", got)
+	}
+}
+
+func TestTryAcquireOrRenewLosesUpdateRace(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	leOld := newTestElector(t, fake.NewLock(store, "old"), clock)
+	if err := leOld.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("old failed to acquire: %v", err)
+	}
+
+	a := &racingLock{Lock: fake.NewLock(store, "a")}
+	leA := newTestElector(t, a, clock)
+	leB := newTestElector(t, fake.NewLock(store, "b"), clock)
+	// both candidates observe the record of old, then it expires
+	for _, le := range []*LeaderElector{leA, leB} {
+		if err := le.tryAcquireOrRenew(context.Background()); err != errLeaseHeld {
+			t.Fatalf("expected the lease to be held by old, got %v", err)
+		}
+	}
+	clock.Step(11 * time.Second)
+
+	a.afterGet = func() {
+		if err := leB.tryAcquireOrRenew(context.Background()); err != nil {
+			t.Fatalf("b failed to take over the expired lease: %v", err)
+		}
+	}
+	err := leA.tryAcquireOrRenew(context.Background())
+	if !rl.IsConflict(err) {
+		t.Fatalf("expected a to lose the race with ErrConflict, got %v", err)
+	}
+	if leA.IsLeader() {
+		t.Errorf("a must not believe it is leader after losing the race")
+	}
+	record := store.Record()
+	if record.HolderIdentity != "b" || record.LeaderTransitions != 1 {
+		t.Errorf("expected b to hold the lease after one transition, got %+v", record)
+	}
+}
+
+func TestTryAcquireOrRenewRenewsOwnLease(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	le := newTestElector(t, fake.NewLock(store, "a"), clock)
+	if err := le.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+	acquired := store.Record().AcquireTime
+
+	clock.Step(5 * time.Second)
+	if err := le.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("failed to renew: %v", err)
+	}
+	record := store.Record()
+	if !record.AcquireTime.Equal(&acquired) {
+		t.Errorf("renewal changed the acquire time from %v to %v", acquired, record.AcquireTime)
+	}
+	if !record.RenewTime.Time.Equal(clock.Now()) {
+		t.Errorf("expected renew time %v, got %v", clock.Now(), record.RenewTime)
+	}
+}
+
+func TestReleaseAfterInterruptedRenewal(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	le := newTestElector(t, fake.NewLock(store, "a"), clock)
+	if err := le.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+	// a renewal stored although the caller gave up on it leaves the lock of
+	// the elector behind the record
+	renewal := *store.Record()
+	stale := fake.NewLock(store, "a")
+	if _, _, err := stale.Get(context.Background()); err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if err := stale.Update(context.Background(), renewal); err != nil {
+		t.Fatalf("error storing renewal: %v", err)
+	}
+
+	if !le.release() {
+		t.Fatalf("failed to release the lease")
+	}
+	if got := store.Record().HolderIdentity; got != "" {
+		t.Errorf("expected the lease to be released, held by %q", got)
+	}
+}
+
+// runLeading runs le with RunE until it leads, and returns a channel that
+// receives the error returned by RunE.
+func runLeading(t *testing.T, ctx context.Context, le *LeaderElector) <-chan error {
+	t.Helper()
+	started := make(chan struct{})
+	le.config.Callbacks.OnStartedLeading = func(context.Context) { close(started) }
+	result := make(chan error, 1)
+	go func() { result <- le.RunE(ctx) }()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%v did not start leading", le.config.Name)
+	}
+	return result
+}
+
+// waitResult waits for the error returned by RunE.
+func waitResult(t *testing.T, result <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("RunE did not return")
+		return nil
+	}
+}
+
+func TestGetLeaderInfoEmptyOnceLeaseExpired(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	holder := fake.NewLock(store, "b")
+	if err := holder.Create(context.Background(), rl.LeaderElectionRecord{HolderIdentity: "b", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	le := newTestElector(t, fake.NewLock(store, "a"), clock)
+	if info := le.GetLeaderInfo(); info.Identity != "" {
+		t.Errorf("expected no leader before observing the record, got %+v", info)
+	}
+	if err := le.tryAcquireOrRenew(context.Background()); !errors.Is(err, errLeaseHeld) {
+		t.Fatalf("expected errLeaseHeld while b leads, got %v", err)
+	}
+	if info := le.GetLeaderInfo(); info.Identity != "b" {
+		t.Errorf("expected the info of b, got %+v", info)
+	}
+
+	// b stops renewing
+	clock.Step(11 * time.Second)
+	if info := le.GetLeaderInfo(); info.Identity != "" {
+		t.Errorf("expected no leader info once the lease expired, got %+v", info)
+	}
+	if leader := le.GetLeader(); leader != "b" {
+		t.Errorf("expected GetLeader to keep returning the observed leader, got %q", leader)
+	}
+}
+
+// brokenWatchLock is a fake lock whose watches break right away.
+type brokenWatchLock struct {
+	*fake.Lock
+	lock    sync.Mutex
+	watches int
+}
+
+func (l *brokenWatchLock) Watch(ctx context.Context) <-chan rl.WatchEvent {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.watches++
+	events := make(chan rl.WatchEvent)
+	close(events)
+	return events
+}
+
+func (l *brokenWatchLock) getWatches() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.watches
+}
+
+func TestAcquireWatchesAgainAfterPolling(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	holder := fake.NewLock(store, "b")
+	if err := holder.Create(context.Background(), rl.LeaderElectionRecord{HolderIdentity: "b", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	lock := &brokenWatchLock{Lock: fake.NewLock(store, "a")}
+	le := newTestElector(t, lock, clock)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	acquired := make(chan bool, 1)
+	go func() { acquired <- le.acquire(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lock.getWatches() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the broken watch to be retried, got %d watches", lock.getWatches())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if <-acquired {
+		t.Errorf("expected a to not acquire the lease held by b")
+	}
+}
+
+func TestRunEContextCancelled(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	le := newTestElector(t, fake.NewLock(fake.NewStore(), "a"), clock)
+	var reason error
+	le.config.Callbacks.OnStoppedLeadingWithReason = func(err error) { reason = err }
+	ctx, cancel := context.WithCancel(context.Background())
+	result := runLeading(t, ctx, le)
+
+	cancel()
+	err := waitResult(t, result)
+	if !errors.Is(err, ErrContextCancelled) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected ErrContextCancelled wrapping context.Canceled, got %v", err)
+	}
+	if reason != err {
+		t.Errorf("OnStoppedLeadingWithReason got %v, RunE returned %v", reason, err)
+	}
+}
+
+func TestRunELeadershipLost(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	le := newTestElector(t, fake.NewLock(store, "a"), clock)
+	result := runLeading(t, context.Background(), le)
+
+	// another writer takes over the record behind the back of a
+	thief := fake.NewLock(store, "b")
+	if _, _, err := thief.Get(context.Background()); err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if err := thief.Update(context.Background(), rl.LeaderElectionRecord{HolderIdentity: "b", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error taking over record: %v", err)
+	}
+
+	if err := waitResult(t, result); !errors.Is(err, ErrLeadershipLost) {
+		t.Errorf("expected ErrLeadershipLost, got %v", err)
+	}
+}
+
+func TestRunERenewDeadlineExceeded(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	lock := fake.NewLock(fake.NewStore(), "a")
+	le := newTestElector(t, lock, clock)
+	result := runLeading(t, context.Background(), le)
+
+	boom := errors.New("boom")
+	lock.SetError(fake.OpGet, boom)
+	lock.SetError(fake.OpUpdate, boom)
+
+	err := waitResult(t, result)
+	if !errors.Is(err, ErrRenewDeadlineExceeded) || !errors.Is(err, boom) {
+		t.Errorf("expected ErrRenewDeadlineExceeded wrapping the lock error, got %v", err)
+	}
+}
+
+func TestTransferToWaitsForLeaderToStop(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	le := newTestElector(t, fake.NewLock(store, "a"), clock)
+	started := make(chan struct{})
+	stopping := make(chan struct{})
+	finish := make(chan struct{})
+	le.config.Callbacks.OnStartedLeading = func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		close(stopping)
+		<-finish
+	}
+	result := make(chan error, 1)
+	go func() { result <- le.RunE(context.Background()) }()
+	<-started
+
+	transferred := make(chan error, 1)
+	go func() { transferred <- le.TransferTo(context.Background(), "b") }()
+	<-stopping
+	// give the term the chance to hand over the lease too early
+	time.Sleep(100 * time.Millisecond)
+	if holder := store.Record().PreferredHolder; holder != "" {
+		t.Fatalf("lease handed over to %q while OnStartedLeading still runs", holder)
+	}
+
+	close(finish)
+	if err := <-transferred; err != nil {
+		t.Fatalf("error transferring leadership: %v", err)
+	}
+	if holder := store.Record().PreferredHolder; holder != "b" {
+		t.Errorf("expected the lease to be handed over to b, got %q", holder)
+	}
+	if err := waitResult(t, result); !errors.Is(err, ErrLeadershipTransferred) {
+		t.Errorf("expected ErrLeadershipTransferred, got %v", err)
+	}
+}
+
+// recordingMetrics records the leader gauge and the failed renewals.
+type recordingMetrics struct {
+	noMetrics
+	lock          sync.Mutex
+	leading       bool
+	renewFailures int
+}
+
+func (m *recordingMetrics) leaderOn(string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.leading = true
+}
+
+func (m *recordingMetrics) leaderOff(string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.leading = false
+}
+
+func (m *recordingMetrics) renewFailed(string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.renewFailures++
+}
+
+func (m *recordingMetrics) get() (bool, int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.leading, m.renewFailures
+}
+
+func TestLeaderMetricOffWhenTermEnds(t *testing.T) {
+	tests := []struct {
+		name string
+		// end ends the term of le, holding the lease of store
+		end  func(t *testing.T, le *LeaderElector, store *fake.Store, cancel context.CancelFunc)
+		want error
+	}{
+		{
+			name: "transferred",
+			end: func(t *testing.T, le *LeaderElector, _ *fake.Store, _ context.CancelFunc) {
+				if err := le.TransferTo(context.Background(), "b"); err != nil {
+					t.Fatalf("error transferring leadership: %v", err)
+				}
+			},
+			want: ErrLeadershipTransferred,
+		},
+		{
+			name: "context cancelled",
+			end: func(_ *testing.T, _ *LeaderElector, _ *fake.Store, cancel context.CancelFunc) {
+				cancel()
+			},
+			want: ErrContextCancelled,
+		},
+		{
+			name: "leadership lost",
+			end: func(t *testing.T, _ *LeaderElector, store *fake.Store, _ context.CancelFunc) {
+				thief := fake.NewLock(store, "b")
+				if _, _, err := thief.Get(context.Background()); err != nil {
+					t.Fatalf("error reading record: %v", err)
+				}
+				if err := thief.Update(context.Background(), rl.LeaderElectionRecord{HolderIdentity: "b", LeaseDurationSeconds: 10}); err != nil {
+					t.Fatalf("error taking over record: %v", err)
+				}
+			},
+			want: ErrLeadershipLost,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := clocktesting.NewFakeClock(time.Now())
+			store := fake.NewStore()
+			le := newTestElector(t, fake.NewLock(store, "a"), clock)
+			metrics := &recordingMetrics{}
+			le.metrics = metrics
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			result := runLeading(t, ctx, le)
+			if leading, _ := metrics.get(); !leading {
+				t.Fatalf("expected the leader gauge to be on while leading")
+			}
+
+			test.end(t, le, store, cancel)
+			if err := waitResult(t, result); !errors.Is(err, test.want) {
+				t.Errorf("expected %v, got %v", test.want, err)
+			}
+			if leading, _ := metrics.get(); leading {
+				t.Errorf("expected the leader gauge to be off once the term ended")
+			}
+		})
+	}
+}
+
+func TestRenewFailure(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	boom := errors.New("boom")
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		lastErr error
+		want    []error
+	}{
+		{"context cancelled", cancelled, boom, []error{ErrContextCancelled, context.Canceled}},
+		{"lease held", context.Background(), errLeaseHeld, []error{ErrLeadershipLost}},
+		{"lost race", context.Background(), rl.ErrConflict, []error{ErrLeadershipLost}},
+		{"lock error", context.Background(), boom, []error{ErrRenewDeadlineExceeded, boom}},
+		{"no attempt", context.Background(), nil, []error{ErrRenewDeadlineExceeded}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := renewFailure(test.ctx, test.lastErr)
+			for _, want := range test.want {
+				if !errors.Is(err, want) {
+					t.Errorf("expected %v to wrap %v", err, want)
+				}
+			}
+		})
+	}
+}
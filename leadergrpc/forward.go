@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leadergrpc
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// forwardUnary forwards a unary call of method to leader.
+func forwardUnary(ctx context.Context, conn *grpc.ClientConn, leader, method string, req interface{}) (interface{}, error) {
+	desc, err := methodDescriptor(method)
+	if err != nil {
+		return nil, err
+	}
+	reply := newMessage(desc.Output())
+	var header, trailer metadata.MD
+	err = conn.Invoke(outgoingContext(ctx, leader), method, req, reply, grpc.Header(&header), grpc.Trailer(&trailer))
+	grpc.SetHeader(ctx, header)
+	grpc.SetTrailer(ctx, trailer)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// forwardStream forwards a streaming call of method to leader, relaying the
+// messages in both directions until the leader ends the call.
+func forwardStream(ss grpc.ServerStream, conn *grpc.ClientConn, leader, method string) error {
+	desc, err := methodDescriptor(method)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(outgoingContext(ss.Context(), leader))
+	defer cancel()
+	cs, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, method)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			m := newMessage(desc.Input())
+			if err := ss.RecvMsg(m); err != nil {
+				if err == io.EOF {
+					cs.CloseSend()
+				} else {
+					cancel()
+				}
+				return
+			}
+			// a failed send ends the call, which is reported by RecvMsg
+			if err := cs.SendMsg(m); err != nil {
+				return
+			}
+		}
+	}()
+
+	if header, err := cs.Header(); err == nil && len(header) > 0 {
+		if err := ss.SendHeader(header); err != nil {
+			return err
+		}
+	}
+	for {
+		m := newMessage(desc.Output())
+		if err := cs.RecvMsg(m); err != nil {
+			ss.SetTrailer(cs.Trailer())
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := ss.SendMsg(m); err != nil {
+			return err
+		}
+	}
+}
+
+// outgoingContext returns the context of a call forwarded to leader, carrying
+// the incoming metadata of ctx.
+func outgoingContext(ctx context.Context, leader string) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	out := metadata.MD{}
+	for k, v := range md {
+		// the transport sets these itself
+		if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") || k == "content-type" || k == "user-agent" {
+			continue
+		}
+		out[k] = v
+	}
+	out.Set(ForwardedKey, leader)
+	return metadata.NewOutgoingContext(ctx, out)
+}
+
+// methodDescriptor looks up the descriptor of method, "/package.Service/Method",
+// in the global registry.
+func methodDescriptor(method string) (protoreflect.MethodDescriptor, error) {
+	name := protoreflect.FullName(strings.ReplaceAll(strings.TrimPrefix(method, "/"), "/", "."))
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(name)
+	if err != nil {
+		return nil, status.Errorf(codes.Unimplemented, "cannot forward unknown method %v: %v", method, err)
+	}
+	md, ok := desc.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "cannot forward %v, it is no method", method)
+	}
+	return md, nil
+}
+
+// newMessage returns a new message of desc, of its generated type if it is
+// registered.
+func newMessage(desc protoreflect.MessageDescriptor) proto.Message {
+	if mt, err := protoregistry.GlobalTypes.FindMessageByName(desc.FullName()); err == nil {
+		return mt.New().Interface()
+	}
+	return dynamicpb.NewMessage(desc)
+}
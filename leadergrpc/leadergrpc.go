@@ -0,0 +1,263 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+// Package leadergrpc implements gRPC server interceptors for methods that
+// must be served by the leader of an election.
+package leadergrpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/khh403/leaderelection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// LeaderIdentityKey is the trailer metadata key carrying the identity of
+	// the leader when a call is rejected with codes.Unavailable.
+	LeaderIdentityKey = "x-leader-identity"
+	// ForwardedKey is set in the metadata of calls forwarded to the leader,
+	// to the identity of the leader they are forwarded to. A process that is
+	// not the leader does not forward such a call again, so that a stale view
+	// of the leader cannot make calls loop.
+	ForwardedKey = "x-leader-forwarded-to"
+)
+
+// Policy selects how a method is served.
+type Policy int
+
+const (
+	// Any serves the method on any process.
+	Any Policy = iota
+	// LeaderOnly serves the method on the leader, and rejects it with
+	// codes.Unavailable on the other processes.
+	LeaderOnly
+	// Forward serves the method on the leader, and forwards it to the leader
+	// from the other processes.
+	Forward
+)
+
+// Elector reports the leader of an election. It is implemented by
+// *leaderelection.LeaderElector.
+type Elector interface {
+	// IsLeader returns true if this process is the leader.
+	IsLeader() bool
+	// GetLeaderInfo returns the leader and its advertised metadata.
+	GetLeaderInfo() leaderelection.LeaderInfo
+}
+
+// Config configures the interceptors.
+type Config struct {
+	// Elector reports the leader.
+	Elector Elector
+	// Policies maps full method names, "/package.Service/Method", or service
+	// prefixes, "/package.Service/", to the policy of the methods.
+	Policies map[string]Policy
+	// DefaultPolicy applies to the methods not in Policies. Defaults to Any.
+	DefaultPolicy Policy
+	// DialOptions are used to connect to the leader. Defaults to insecure
+	// transport credentials.
+	DialOptions []grpc.DialOption
+}
+
+// Interceptor decides per method whether a call is served locally,
+// forwarded to the leader or rejected. The leader is dialed at the host of
+// its advertised resourcelock.MetadataAddress and resourcelock.MetadataGRPCPort,
+// or at the address if it advertises no gRPC port. The connection is reused
+// until the leader changes, and closed once the calls forwarded on it are
+// done.
+type Interceptor struct {
+	config Config
+
+	// lock protects the pooled connection to the leader, and the call
+	// counts of all connections
+	lock sync.Mutex
+	conn *pooledConn
+}
+
+// pooledConn is a connection to the leader at target, with the number of
+// calls being forwarded on it.
+type pooledConn struct {
+	*grpc.ClientConn
+	target string
+	calls  int
+	// retired is set once the connection is no longer pooled, it is closed
+	// when calls drops to zero.
+	retired bool
+}
+
+// New creates an Interceptor from a Config.
+func New(config Config) (*Interceptor, error) {
+	if config.Elector == nil {
+		return nil, fmt.Errorf("Elector must not be nil")
+	}
+	if len(config.DialOptions) == 0 {
+		config.DialOptions = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	return &Interceptor{config: config}, nil
+}
+
+// UnaryServerInterceptor returns the unary server interceptor.
+func (i *Interceptor) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		conn, leader, err := i.route(ctx, info.FullMethod, func(md metadata.MD) { grpc.SetTrailer(ctx, md) })
+		if err != nil {
+			return nil, err
+		}
+		if conn == nil {
+			return handler(ctx, req)
+		}
+		defer i.release(conn)
+		return forwardUnary(ctx, conn.ClientConn, leader, info.FullMethod, req)
+	}
+}
+
+// StreamServerInterceptor returns the stream server interceptor.
+func (i *Interceptor) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		conn, leader, err := i.route(ss.Context(), info.FullMethod, ss.SetTrailer)
+		if err != nil {
+			return err
+		}
+		if conn == nil {
+			return handler(srv, ss)
+		}
+		defer i.release(conn)
+		return forwardStream(ss, conn.ClientConn, leader, info.FullMethod)
+	}
+}
+
+// Close closes the pooled connection to the leader, once the calls forwarded
+// on it are done.
+func (i *Interceptor) Close() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.conn == nil {
+		return nil
+	}
+	err := i.retire(i.conn)
+	i.conn = nil
+	return err
+}
+
+// policy returns the policy of method.
+func (i *Interceptor) policy(method string) Policy {
+	if policy, ok := i.config.Policies[method]; ok {
+		return policy
+	}
+	if n := strings.LastIndex(method, "/"); n > 0 {
+		if policy, ok := i.config.Policies[method[:n+1]]; ok {
+			return policy
+		}
+	}
+	return i.config.DefaultPolicy
+}
+
+// route decides how a call of method is served. It returns a nil connection
+// and error if it is served locally, the connection to forward it on and the
+// identity of the leader, or the error to reject it with. setTrailer sets
+// the trailer of the rejected call. A returned connection must be released
+// once the call is done.
+func (i *Interceptor) route(ctx context.Context, method string, setTrailer func(metadata.MD)) (*pooledConn, string, error) {
+	policy := i.policy(method)
+	if policy == Any || i.config.Elector.IsLeader() {
+		return nil, "", nil
+	}
+
+	leader := i.config.Elector.GetLeaderInfo()
+	if leader.Identity == "" {
+		return nil, "", status.Error(codes.Unavailable, "no leader")
+	}
+	setTrailer(metadata.Pairs(LeaderIdentityKey, leader.Identity))
+	if policy == LeaderOnly {
+		return nil, "", status.Errorf(codes.Unavailable, "not the leader, the leader is %v", leader.Identity)
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(ForwardedKey)) > 0 {
+		klog.V(4).Infof("not forwarding call of %v again, it was forwarded to %v which is no leader", method, md.Get(ForwardedKey)[0])
+		return nil, "", status.Error(codes.Unavailable, "leader changed")
+	}
+	target := leaderTarget(leader)
+	if target == "" {
+		return nil, "", status.Errorf(codes.Unavailable, "leader %v does not advertise an address", leader.Identity)
+	}
+	conn, err := i.dial(target)
+	if err != nil {
+		klog.Errorf("error dialing leader %v at %v: %v", leader.Identity, target, err)
+		return nil, "", status.Errorf(codes.Unavailable, "error dialing leader %v: %v", leader.Identity, err)
+	}
+	return conn, leader.Identity, nil
+}
+
+// dial returns the pooled connection to target for a call, replacing the
+// connection to a previous leader. The connection must be released once the
+// call is done.
+func (i *Interceptor) dial(target string) (*pooledConn, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.conn == nil || i.conn.target != target {
+		conn, err := grpc.Dial(target, i.config.DialOptions...)
+		if err != nil {
+			return nil, err
+		}
+		if i.conn != nil {
+			i.retire(i.conn)
+		}
+		i.conn = &pooledConn{ClientConn: conn, target: target}
+	}
+	i.conn.calls++
+	return i.conn, nil
+}
+
+// release ends a call forwarded on conn, closing conn if it was retired and
+// this was its last call.
+func (i *Interceptor) release(conn *pooledConn) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	conn.calls--
+	if conn.retired && conn.calls == 0 {
+		conn.Close()
+	}
+}
+
+// retire removes conn from the pool, closing it right away if no calls are
+// forwarded on it. The caller must hold i.lock.
+func (i *Interceptor) retire(conn *pooledConn) error {
+	conn.retired = true
+	if conn.calls > 0 {
+		return nil
+	}
+	return conn.Close()
+}
+
+// leaderTarget returns the gRPC target of leader, empty if unknown.
+func leaderTarget(leader leaderelection.LeaderInfo) string {
+	address, port := leader.Address(), leader.GRPCPort()
+	if address == "" || port == "" {
+		return address
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return net.JoinHostPort(host, port)
+}
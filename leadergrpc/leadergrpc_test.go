@@ -0,0 +1,215 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leadergrpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/khh403/leaderelection"
+	rl "github.com/khh403/leaderelection/resourcelock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeElector reports a leader that may be changed by the test.
+type fakeElector struct {
+	lock   sync.Mutex
+	leader bool
+	info   leaderelection.LeaderInfo
+}
+
+func (e *fakeElector) IsLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.leader
+}
+
+func (e *fakeElector) GetLeaderInfo() leaderelection.LeaderInfo {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.info
+}
+
+func (e *fakeElector) setLeader(identity, address string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.info = leaderelection.LeaderInfo{
+		Identity: identity,
+		Metadata: map[string]string{rl.MetadataAddress: address},
+	}
+}
+
+// startServer serves the health service on a local port, with the
+// interceptors of i if not nil. It returns the address and health server.
+func startServer(t *testing.T, i *Interceptor) (string, *health.Server) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	var opts []grpc.ServerOption
+	if i != nil {
+		opts = append(opts,
+			grpc.UnaryInterceptor(i.UnaryServerInterceptor()),
+			grpc.StreamInterceptor(i.StreamServerInterceptor()))
+	}
+	server := grpc.NewServer(opts...)
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String(), healthServer
+}
+
+func newHealthClient(t *testing.T, address string) healthpb.HealthClient {
+	t.Helper()
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("error dialing %v: %v", address, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+func TestPolicy(t *testing.T) {
+	i, err := New(Config{
+		Elector: &fakeElector{},
+		Policies: map[string]Policy{
+			"/grpc.health.v1.Health/":      LeaderOnly,
+			"/grpc.health.v1.Health/Check": Forward,
+		},
+	})
+	if err != nil {
+		t.Fatalf("error creating interceptor: %v", err)
+	}
+	for method, want := range map[string]Policy{
+		"/grpc.health.v1.Health/Check": Forward,
+		"/grpc.health.v1.Health/Watch": LeaderOnly,
+		"/other.Service/Method":        Any,
+	} {
+		if got := i.policy(method); got != want {
+			t.Errorf("expected policy %v of %v, got %v", want, method, got)
+		}
+	}
+}
+
+func TestLeaderOnly(t *testing.T) {
+	elector := &fakeElector{}
+	i, err := New(Config{Elector: elector, DefaultPolicy: LeaderOnly})
+	if err != nil {
+		t.Fatalf("error creating interceptor: %v", err)
+	}
+	address, _ := startServer(t, i)
+	client := newHealthClient(t, address)
+
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable without a leader, got %v", err)
+	}
+	elector.setLeader("a", "127.0.0.1:1")
+	var trailer metadata.MD
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}, grpc.Trailer(&trailer)); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable on a follower, got %v", err)
+	}
+	if got := trailer.Get(LeaderIdentityKey); len(got) != 1 || got[0] != "a" {
+		t.Errorf("expected the leader in the trailer, got %v", got)
+	}
+	elector.lock.Lock()
+	elector.leader = true
+	elector.lock.Unlock()
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Errorf("expected the leader to serve the call, got %v", err)
+	}
+}
+
+func TestForwardLoop(t *testing.T) {
+	elector := &fakeElector{}
+	elector.setLeader("a", "127.0.0.1:1")
+	i, err := New(Config{Elector: elector, DefaultPolicy: Forward})
+	if err != nil {
+		t.Fatalf("error creating interceptor: %v", err)
+	}
+	defer i.Close()
+	address, _ := startServer(t, i)
+	client := newHealthClient(t, address)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), ForwardedKey, "b")
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected a forwarded call not to be forwarded again, got %v", err)
+	}
+}
+
+func TestLeaderChangeKeepsForwardedCalls(t *testing.T) {
+	addressA, healthA := startServer(t, nil)
+	addressB, _ := startServer(t, nil)
+	elector := &fakeElector{}
+	elector.setLeader("a", addressA)
+	i, err := New(Config{Elector: elector, DefaultPolicy: Forward})
+	if err != nil {
+		t.Fatalf("error creating interceptor: %v", err)
+	}
+	defer i.Close()
+	address, _ := startServer(t, i)
+	client := newHealthClient(t, address)
+
+	// a stream forwarded to a outlives the leader change
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "test"})
+	if err != nil {
+		t.Fatalf("error watching: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("error receiving from a: %v", err)
+	}
+	i.lock.Lock()
+	connA := i.conn
+	i.lock.Unlock()
+
+	elector.setLeader("b", addressB)
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("error forwarding to b: %v", err)
+	}
+	healthA.SetServingStatus("test", healthpb.HealthCheckResponse_SERVING)
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("stream forwarded to a broke on the leader change: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("expected SERVING, got %v", resp.Status)
+	}
+	if state := connA.GetState(); state == connectivity.Shutdown {
+		t.Errorf("connection to a closed while a call is forwarded on it")
+	}
+
+	// the connection to a is closed once its last call is done
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for connA.GetState() != connectivity.Shutdown {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection to a was not closed after its calls were done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+// Package leaderhttp implements an http.Handler middleware that serves
+// requests on the leader of an election and forwards them to it from the
+// other candidates.
+package leaderhttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/khh403/leaderelection"
+	"k8s.io/klog/v2"
+)
+
+// ForwardedHeader is set on requests forwarded to the leader, to the identity
+// of the leader they are forwarded to. A process that is not the leader
+// does not forward such a request again, so that a stale view of the leader
+// cannot make requests loop.
+const ForwardedHeader = "X-Leader-Forwarded-To"
+
+// RedirectedParam is the query parameter added to redirects to the leader, set
+// to the identity of the leader the request is redirected to. Like
+// ForwardedHeader, it keeps a process that is not the leader from redirecting
+// the request again. The leader removes it before serving the request.
+const RedirectedParam = "leader-redirected-to"
+
+// Mode selects how requests are forwarded to the leader.
+type Mode int
+
+const (
+	// Proxy serves the request by reverse-proxying it to the leader.
+	Proxy Mode = iota
+	// Redirect answers with a 307 redirect to the leader, marked with
+	// RedirectedParam. Clients must follow redirects for it to work.
+	Redirect
+)
+
+// Elector reports the leader of an election. It is implemented by
+// *leaderelection.LeaderElector.
+type Elector interface {
+	// IsLeader returns true if this process is the leader.
+	IsLeader() bool
+	// GetLeaderInfo returns the leader and its advertised metadata.
+	GetLeaderInfo() leaderelection.LeaderInfo
+}
+
+// Observing returns an Elector for a process that never leads, tracking the
+// leader with lo.
+func Observing(lo *leaderelection.LeaderObserver) Elector {
+	return observing{lo}
+}
+
+type observing struct {
+	*leaderelection.LeaderObserver
+}
+
+func (observing) IsLeader() bool {
+	return false
+}
+
+// Config configures the middleware.
+type Config struct {
+	// Elector reports the leader.
+	Elector Elector
+	// Mode selects how requests are forwarded. Defaults to Proxy.
+	Mode Mode
+	// Scheme is the scheme of the address advertised by the leader in the
+	// resourcelock.MetadataAddress metadata. Defaults to "http".
+	Scheme string
+	// Transport is used to proxy requests. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+// New returns a handler that serves requests with next if this process is
+// the leader, and forwards them to the leader otherwise. It answers with
+// 503 Service Unavailable if the leader or its address is not known.
+func New(config Config, next http.Handler) (http.Handler, error) {
+	if config.Elector == nil {
+		return nil, fmt.Errorf("Elector must not be nil")
+	}
+	if next == nil {
+		return nil, fmt.Errorf("next handler must not be nil")
+	}
+	if config.Mode != Proxy && config.Mode != Redirect {
+		return nil, fmt.Errorf("unknown mode %v", config.Mode)
+	}
+	if config.Scheme == "" {
+		config.Scheme = "http"
+	}
+	h := &handler{
+		config: config,
+		next:   next,
+	}
+	h.proxy = &httputil.ReverseProxy{
+		Rewrite:      h.rewrite,
+		Transport:    config.Transport,
+		ErrorHandler: h.proxyError,
+	}
+	return h, nil
+}
+
+// Middleware returns New as a middleware, panicking on an invalid config.
+func Middleware(config Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		h, err := New(config, next)
+		if err != nil {
+			panic(err)
+		}
+		return h
+	}
+}
+
+type handler struct {
+	config Config
+	next   http.Handler
+	proxy  *httputil.ReverseProxy
+}
+
+// targetKey is the context key of the leader a request is proxied to.
+type targetKey struct{}
+
+type target struct {
+	url      *url.URL
+	identity string
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	_, redirected := query[RedirectedParam]
+	if h.config.Elector.IsLeader() {
+		if redirected {
+			r = withoutRedirectedParam(r, query)
+		}
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	forwardedTo := r.Header.Get(ForwardedHeader)
+	if redirected {
+		forwardedTo = query.Get(RedirectedParam)
+	}
+	if forwardedTo != "" || redirected {
+		klog.V(4).Infof("not forwarding request for %v again, it was forwarded to %v which is no leader", r.URL.Path, forwardedTo)
+		unavailable(w, "leader changed")
+		return
+	}
+	leader := h.config.Elector.GetLeaderInfo()
+	if leader.Identity == "" {
+		unavailable(w, "no leader")
+		return
+	}
+	address := leader.Address()
+	if address == "" {
+		unavailable(w, fmt.Sprintf("leader %v does not advertise an address", leader.Identity))
+		return
+	}
+	u := &url.URL{Scheme: h.config.Scheme, Host: address}
+
+	if h.config.Mode == Redirect {
+		location := *r.URL
+		location.Scheme, location.Host = u.Scheme, u.Host
+		query.Set(RedirectedParam, leader.Identity)
+		location.RawQuery = query.Encode()
+		http.Redirect(w, r, location.String(), http.StatusTemporaryRedirect)
+		return
+	}
+	ctx := context.WithValue(r.Context(), targetKey{}, target{url: u, identity: leader.Identity})
+	h.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// withoutRedirectedParam returns a shallow copy of r without RedirectedParam
+// in its query, which is passed parsed.
+func withoutRedirectedParam(r *http.Request, query url.Values) *http.Request {
+	query.Del(RedirectedParam)
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.RawQuery = query.Encode()
+	return r2
+}
+
+// rewrite directs a proxied request to the leader.
+func (h *handler) rewrite(pr *httputil.ProxyRequest) {
+	t := pr.In.Context().Value(targetKey{}).(target)
+	pr.SetURL(t.url)
+	pr.SetXForwarded()
+	pr.Out.Header.Set(ForwardedHeader, t.identity)
+}
+
+func (h *handler) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	t := r.Context().Value(targetKey{}).(target)
+	klog.Errorf("error proxying request for %v to leader %v: %v", r.URL.Path, t.identity, err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// unavailable answers that the request cannot be served for now.
+func unavailable(w http.ResponseWriter, reason string) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, reason, http.StatusServiceUnavailable)
+}
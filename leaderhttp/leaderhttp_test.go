@@ -0,0 +1,153 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/khh403/leaderelection"
+	rl "github.com/khh403/leaderelection/resourcelock"
+)
+
+// fakeElector reports a fixed leader.
+type fakeElector struct {
+	leader bool
+	info   leaderelection.LeaderInfo
+}
+
+func (e *fakeElector) IsLeader() bool {
+	return e.leader
+}
+
+func (e *fakeElector) GetLeaderInfo() leaderelection.LeaderInfo {
+	return e.info
+}
+
+func leaderAt(identity, address string) leaderelection.LeaderInfo {
+	return leaderelection.LeaderInfo{
+		Identity: identity,
+		Metadata: map[string]string{rl.MetadataAddress: address},
+	}
+}
+
+// echo answers with the query of the request it serves.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.URL.RawQuery))
+})
+
+func newHandler(t *testing.T, elector Elector, mode Mode) http.Handler {
+	t.Helper()
+	h, err := New(Config{Elector: elector, Mode: mode}, echo)
+	if err != nil {
+		t.Fatalf("error creating handler: %v", err)
+	}
+	return h
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestLeaderServes(t *testing.T) {
+	h := newHandler(t, &fakeElector{leader: true}, Proxy)
+	w := serve(h, httptest.NewRequest(http.MethodGet, "/?a=1", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "a=1" {
+		t.Errorf("expected the leader to serve the request, got %v %q", w.Code, w.Body)
+	}
+}
+
+func TestNoLeader(t *testing.T) {
+	for name, info := range map[string]leaderelection.LeaderInfo{
+		"no leader":  {},
+		"no address": {Identity: "a"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := newHandler(t, &fakeElector{info: info}, Proxy)
+			w := serve(h, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+				t.Errorf("expected 503 with Retry-After, got %v", w.Code)
+			}
+		})
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var forwardedTo string
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedTo = r.Header.Get(ForwardedHeader)
+		echo(w, r)
+	}))
+	defer leader.Close()
+	address := strings.TrimPrefix(leader.URL, "http://")
+
+	h := newHandler(t, &fakeElector{info: leaderAt("a", address)}, Proxy)
+	w := serve(h, httptest.NewRequest(http.MethodGet, "/?a=1", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "a=1" {
+		t.Errorf("expected the request to be proxied, got %v %q", w.Code, w.Body)
+	}
+	if forwardedTo != "a" {
+		t.Errorf("expected %v to be set to the leader, got %q", ForwardedHeader, forwardedTo)
+	}
+}
+
+func TestProxyLoop(t *testing.T) {
+	h := newHandler(t, &fakeElector{info: leaderAt("a", "127.0.0.1:1")}, Proxy)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(ForwardedHeader, "b")
+	if w := serve(h, r); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a forwarded request not to be forwarded again, got %v", w.Code)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	h := newHandler(t, &fakeElector{info: leaderAt("a", "10.0.0.1:8080")}, Redirect)
+	w := serve(h, httptest.NewRequest(http.MethodGet, "/path?a=1", nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected a redirect, got %v", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("error parsing location: %v", err)
+	}
+	if location.Host != "10.0.0.1:8080" || location.Path != "/path" {
+		t.Errorf("expected a redirect to the leader, got %v", location)
+	}
+	query := location.Query()
+	if query.Get("a") != "1" || query.Get(RedirectedParam) != "a" {
+		t.Errorf("expected the query marked as redirected to a, got %v", location.RawQuery)
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	h := newHandler(t, &fakeElector{info: leaderAt("a", "10.0.0.1:8080")}, Redirect)
+	r := httptest.NewRequest(http.MethodGet, "/?"+RedirectedParam+"=b", nil)
+	if w := serve(h, r); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a redirected request not to be redirected again, got %v", w.Code)
+	}
+}
+
+func TestLeaderRemovesRedirectedParam(t *testing.T) {
+	h := newHandler(t, &fakeElector{leader: true}, Redirect)
+	w := serve(h, httptest.NewRequest(http.MethodGet, "/?a=1&"+RedirectedParam+"=a", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "a=1" {
+		t.Errorf("expected the leader to serve the request without %v, got %v %q", RedirectedParam, w.Code, w.Body)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"time"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+)
+
+// LeaderInfo describes the observed leader of an election.
+type LeaderInfo struct {
+	// Identity is the identity of the leader, empty if there is none.
+	Identity string
+	// Metadata is the metadata advertised by the leader.
+	Metadata map[string]string
+	// AcquireTime and RenewTime are the times the leader acquired and last
+	// renewed the lease.
+	AcquireTime time.Time
+	RenewTime   time.Time
+}
+
+// Address returns the address advertised by the leader, empty if unknown.
+func (li LeaderInfo) Address() string {
+	return li.Metadata[rl.MetadataAddress]
+}
+
+// GRPCPort returns the gRPC port advertised by the leader, empty if unknown.
+func (li LeaderInfo) GRPCPort() string {
+	return li.Metadata[rl.MetadataGRPCPort]
+}
+
+// Version returns the version advertised by the leader, empty if unknown.
+func (li LeaderInfo) Version() string {
+	return li.Metadata[rl.MetadataVersion]
+}
+
+// newLeaderInfo returns the LeaderInfo of record.
+func newLeaderInfo(record rl.LeaderElectionRecord) LeaderInfo {
+	metadata := make(map[string]string, len(record.HolderMetadata))
+	for k, v := range record.HolderMetadata {
+		metadata[k] = v
+	}
+	return LeaderInfo{
+		Identity:    record.HolderIdentity,
+		Metadata:    metadata,
+		AcquireTime: record.AcquireTime.Time,
+		RenewTime:   record.RenewTime.Time,
+	}
+}
+
+// GetLeaderInfo returns the last observed leader and its advertised metadata,
+// or an empty LeaderInfo if the lease of the observed leader has expired.
+// This function is for informational purposes, e.g. forwarding requests to the leader.
+func (le *LeaderElector) GetLeaderInfo() LeaderInfo {
+	if !le.isLeaseValid(le.clock.Now()) {
+		return newLeaderInfo(rl.LeaderElectionRecord{})
+	}
+	return newLeaderInfo(le.getObservedRecord())
+}
+
+// GetLeaderInfo returns the last observed leader and its advertised metadata,
+// or an empty LeaderInfo if the lease of the observed leader has expired.
+func (lo *LeaderObserver) GetLeaderInfo() LeaderInfo {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	if lo.leaseExpired() {
+		return newLeaderInfo(rl.LeaderElectionRecord{})
+	}
+	return newLeaderInfo(lo.observedRecord)
+}
+
+// advertisedMetadata returns the metadata to advertise in the election record.
+func (le *LeaderElector) advertisedMetadata() map[string]string {
+	if advertiser, ok := le.config.Lock.(rl.Advertiser); ok {
+		return advertiser.Metadata()
+	}
+	return nil
+}
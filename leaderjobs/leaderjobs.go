@@ -0,0 +1,267 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+// Package leaderjobs runs periodic jobs on the leader of an election.
+//
+// Jobs are registered with a Scheduler, which is run with the context passed
+// to OnStartedLeading. Every run gets a context that is cancelled when the
+// leadership is lost. The time of the last run of every job is kept in etcd,
+// so that a new leader does not run a job again that its predecessor ran just
+// before failing over.
+package leaderjobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/khh403/leaderelection"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+// Config configures a Scheduler.
+type Config struct {
+	// Client is the etcd client the last runs are kept with.
+	Client *clientv3.Client
+	// Prefix is the etcd key prefix of the last runs, the last run of job
+	// name is stored under <prefix>/<name>.
+	Prefix string
+	// RetryPeriod is the duration to wait before retrying to read or write
+	// the last run of a job. Defaults to one second.
+	RetryPeriod time.Duration
+	// Clock can be used to inject a clock. Defaults to the real clock.
+	Clock clock.Clock
+}
+
+// Record is the bookkeeping of the last run of a job.
+type Record struct {
+	// LastRun is the time the last run started.
+	LastRun time.Time `json:"lastRun"`
+	// LastFinish is the time the last run finished, zero while it runs or
+	// if the leader running it died.
+	LastFinish time.Time `json:"lastFinish,omitempty"`
+	// LastError is the error the last run returned.
+	LastError string `json:"lastError,omitempty"`
+	// FencingToken is the fencing token of the leader that ran it.
+	FencingToken int64 `json:"fencingToken,omitempty"`
+}
+
+// Scheduler runs the registered jobs while it is run by the leader.
+type Scheduler struct {
+	config Config
+	clock  clock.Clock
+
+	// lock protects jobs
+	lock sync.Mutex
+	jobs map[string]*job
+}
+
+type job struct {
+	name     string
+	schedule Schedule
+	run      func(ctx context.Context) error
+}
+
+// New creates a Scheduler from a Config.
+func New(config Config) (*Scheduler, error) {
+	if config.Client == nil {
+		return nil, fmt.Errorf("Client must not be nil")
+	}
+	if config.Prefix == "" {
+		return nil, fmt.Errorf("Prefix must not be empty")
+	}
+	if config.RetryPeriod == 0 {
+		config.RetryPeriod = time.Second
+	}
+	if config.Clock == nil {
+		config.Clock = clock.RealClock{}
+	}
+	return &Scheduler{
+		config: config,
+		clock:  config.Clock,
+		jobs:   map[string]*job{},
+	}, nil
+}
+
+// Register registers the job name, run on schedule. Jobs must be registered
+// before the Scheduler is run. The schedule must advance, a schedule whose
+// next run is not after now, like Every(0), is rejected.
+func (s *Scheduler) Register(name string, schedule Schedule, run func(ctx context.Context) error) error {
+	if name == "" {
+		return fmt.Errorf("job name must not be empty")
+	}
+	if schedule == nil {
+		return fmt.Errorf("schedule of job %v must not be nil", name)
+	}
+	if now := s.clock.Now(); !schedule.Next(now).After(now) {
+		return fmt.Errorf("schedule of job %v does not advance", name)
+	}
+	if run == nil {
+		return fmt.Errorf("job %v must not be nil", name)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.jobs[name]; ok {
+		return fmt.Errorf("job %v is already registered", name)
+	}
+	s.jobs[name] = &job{name: name, schedule: schedule, run: run}
+	return nil
+}
+
+// Run runs the registered jobs on their schedules until ctx is done, and
+// waits for the running jobs to return. It is meant to be called with the
+// context passed to OnStartedLeading.
+func (s *Scheduler) Run(ctx context.Context) {
+	defer runtime.HandleCrash()
+	s.lock.Lock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	s.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		j := j
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runJob(ctx, j)
+		}()
+	}
+	wg.Wait()
+}
+
+// LastRun returns the bookkeeping of the last run of job name, nil if it has
+// not run yet.
+func (s *Scheduler) LastRun(ctx context.Context, name string) (*Record, error) {
+	record, _, err := s.load(ctx, name)
+	return record, err
+}
+
+// runJob runs j on its schedule until ctx is done.
+func (s *Scheduler) runJob(ctx context.Context, j *job) {
+	start := s.clock.Now()
+	for ctx.Err() == nil {
+		record, rev, err := s.load(ctx, j.name)
+		if err != nil {
+			klog.Errorf("error reading last run of job %v: %v", j.name, err)
+			s.sleep(ctx, s.config.RetryPeriod)
+			continue
+		}
+		last := start
+		if record != nil {
+			last = record.LastRun
+		}
+		if !s.sleep(ctx, j.schedule.Next(last).Sub(s.clock.Now())) {
+			return
+		}
+
+		// claim the run, unless the last run changed in the meantime, e.g. by
+		// a previous leader that did not notice losing the lease yet
+		record = &Record{LastRun: s.clock.Now()}
+		if token, ok := leaderelection.FencingTokenFromContext(ctx); ok {
+			record.FencingToken = token
+		}
+		rev, err = s.store(ctx, j.name, rev, record)
+		if err != nil {
+			klog.Errorf("error claiming run of job %v: %v", j.name, err)
+			s.sleep(ctx, s.config.RetryPeriod)
+			continue
+		}
+		if rev == 0 {
+			klog.V(4).Infof("run of job %v was claimed concurrently", j.name)
+			continue
+		}
+
+		klog.V(4).Infof("running job %v", j.name)
+		if err := j.run(ctx); err != nil {
+			klog.Errorf("job %v failed: %v", j.name, err)
+			record.LastError = err.Error()
+		}
+		record.LastFinish = s.clock.Now()
+		// the run is claimed already, so the bookkeeping is updated even if
+		// ctx is done
+		storeCtx, cancel := context.WithTimeout(context.Background(), s.config.RetryPeriod)
+		if _, err := s.store(storeCtx, j.name, rev, record); err != nil {
+			klog.Errorf("error recording run of job %v: %v", j.name, err)
+		}
+		cancel()
+	}
+}
+
+// sleep waits for d or until ctx is done. Returns false if ctx is done.
+func (s *Scheduler) sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := s.clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C():
+		return true
+	}
+}
+
+// key returns the etcd key of the last run of job name.
+func (s *Scheduler) key(name string) string {
+	return path.Join(s.config.Prefix, name)
+}
+
+// load reads the last run of job name and the etcd revision it was last
+// modified at, nil and 0 if the job has not run yet.
+func (s *Scheduler) load(ctx context.Context, name string) (*Record, int64, error) {
+	resp, err := s.config.Client.Get(ctx, s.key(name))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	var record Record
+	if err := json.Unmarshal(resp.Kvs[0].Value, &record); err != nil {
+		return nil, 0, err
+	}
+	return &record, resp.Kvs[0].ModRevision, nil
+}
+
+// store writes record as the last run of job name if it was last modified
+// at rev, 0 if it has not run yet. It returns the revision record was
+// written at, 0 if the last run was modified since.
+func (s *Scheduler) store(ctx context.Context, name string, rev int64, record *Record) (int64, error) {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	key := s.key(name)
+	resp, err := s.config.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, nil
+	}
+	return resp.Header.Revision, nil
+}
@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderjobs
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/khh403/leaderelection/internal/etcdtest"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdServer is shared by the tests, nil with -short.
+var etcdServer *etcdtest.Server
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Short() {
+		var err error
+		etcdServer, err = etcdtest.Start()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error starting etcd: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	code := m.Run()
+	if etcdServer != nil {
+		etcdServer.Close()
+	}
+	os.Exit(code)
+}
+
+// newTestScheduler creates a Scheduler keeping the last runs under a prefix
+// of the test, with job "job" registered to run every hour and count its
+// runs.
+func newTestScheduler(t *testing.T, client *clientv3.Client, runs *int32) *Scheduler {
+	t.Helper()
+	s, err := New(Config{
+		Client:      client,
+		Prefix:      "/jobs/" + t.Name(),
+		RetryPeriod: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("error creating scheduler: %v", err)
+	}
+	err = s.Register("job", Every(time.Hour), func(context.Context) error {
+		atomic.AddInt32(runs, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error registering job: %v", err)
+	}
+	return s
+}
+
+func newClient(t *testing.T) *clientv3.Client {
+	t.Helper()
+	if etcdServer == nil {
+		t.Skip("skipping etcd test in short mode")
+	}
+	client := etcdServer.NewClient(t)
+	t.Cleanup(func() {
+		client.Delete(context.Background(), "/jobs/"+t.Name(), clientv3.WithPrefix())
+	})
+	return client
+}
+
+// runFor runs the schedulers concurrently for d.
+func runFor(d time.Duration, schedulers ...*Scheduler) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range schedulers {
+		s := s
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Run(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// storeLastRun records a run of job by a previous leader.
+func storeLastRun(t *testing.T, s *Scheduler, lastRun time.Time) {
+	t.Helper()
+	rev, err := s.store(context.Background(), "job", 0, &Record{LastRun: lastRun, LastFinish: lastRun, FencingToken: 1})
+	if err != nil || rev == 0 {
+		t.Fatalf("error storing last run: %v", err)
+	}
+}
+
+func TestRegisterRejectsNonAdvancingSchedule(t *testing.T) {
+	s, err := New(Config{Client: &clientv3.Client{}, Prefix: "/jobs"})
+	if err != nil {
+		t.Fatalf("error creating scheduler: %v", err)
+	}
+	run := func(context.Context) error { return nil }
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := s.Register("job", Every(interval), run); err == nil {
+			t.Errorf("expected Every(%v) to be rejected", interval)
+		}
+	}
+	if err := s.Register("job", Every(time.Second), run); err != nil {
+		t.Errorf("error registering Every(1s): %v", err)
+	}
+}
+
+func TestRecentRunOfPreviousLeaderNotRepeated(t *testing.T) {
+	var runs int32
+	s := newTestScheduler(t, newClient(t), &runs)
+	storeLastRun(t, s, time.Now().Add(-time.Minute))
+
+	runFor(500*time.Millisecond, s)
+	if runs != 0 {
+		t.Errorf("job ran %v times, although the previous leader ran it a minute ago", runs)
+	}
+	record, err := s.LastRun(context.Background(), "job")
+	if err != nil {
+		t.Fatalf("error reading last run: %v", err)
+	}
+	if record.FencingToken != 1 {
+		t.Errorf("expected the run of the previous leader to be kept, got %+v", record)
+	}
+}
+
+func TestOverdueRunOfPreviousLeader(t *testing.T) {
+	var runs int32
+	s := newTestScheduler(t, newClient(t), &runs)
+	lastRun := time.Now().Add(-2 * time.Hour)
+	storeLastRun(t, s, lastRun)
+
+	runFor(500*time.Millisecond, s)
+	if runs != 1 {
+		t.Errorf("expected the overdue job to run once, ran %v times", runs)
+	}
+	record, err := s.LastRun(context.Background(), "job")
+	if err != nil {
+		t.Fatalf("error reading last run: %v", err)
+	}
+	if !record.LastRun.After(lastRun) || record.LastFinish.Before(record.LastRun) {
+		t.Errorf("expected the run to be recorded, got %+v", record)
+	}
+}
+
+func TestConcurrentClaimRunsOnce(t *testing.T) {
+	client := newClient(t)
+	var runs int32
+	// a previous leader that did not notice losing the lease yet runs
+	// alongside the new one
+	previous := newTestScheduler(t, client, &runs)
+	next := newTestScheduler(t, client, &runs)
+	storeLastRun(t, previous, time.Now().Add(-2*time.Hour))
+
+	runFor(500*time.Millisecond, previous, next)
+	if runs != 1 {
+		t.Errorf("expected the overdue job to run once, ran %v times", runs)
+	}
+}
+
+func TestStoreStaleRevision(t *testing.T) {
+	var runs int32
+	s := newTestScheduler(t, newClient(t), &runs)
+	storeLastRun(t, s, time.Now())
+	_, rev, err := s.load(context.Background(), "job")
+	if err != nil {
+		t.Fatalf("error reading last run: %v", err)
+	}
+	if rev, err = s.store(context.Background(), "job", rev, &Record{LastRun: time.Now()}); err != nil || rev == 0 {
+		t.Fatalf("error claiming run: %v", err)
+	}
+	if rev, err := s.store(context.Background(), "job", rev-1, &Record{LastRun: time.Now()}); err != nil || rev != 0 {
+		t.Errorf("expected a claim at a stale revision to fail, got revision %v, %v", rev, err)
+	}
+}
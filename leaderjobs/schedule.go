@@ -0,0 +1,50 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderjobs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule describes when a job runs.
+type Schedule interface {
+	// Next returns the next time the job runs after t.
+	Next(t time.Time) time.Time
+}
+
+// Every returns a Schedule running a job every interval. The interval must
+// be positive, Register rejects schedules that do not advance.
+func Every(interval time.Duration) Schedule {
+	return every(interval)
+}
+
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// Cron parses a standard cron spec, with five fields or a descriptor like
+// "@hourly", into a Schedule.
+func Cron(spec string) (Schedule, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron spec %q: %w", spec, err)
+	}
+	return schedule, nil
+}
@@ -16,6 +16,7 @@ package leaderelection
 
 import (
 	"sync"
+	"time"
 )
 
 // This file provides abstractions for setting the provider (e.g., prometheus)
@@ -25,6 +26,11 @@ type leaderMetricsAdapter interface {
 	leaderOn(name string)
 	leaderOff(name string)
 	slowpathExercised(name string)
+	acquireAttempt(name string)
+	renewLatency(name string, latency time.Duration)
+	renewFailed(name string)
+	transition(name string)
+	leaseAge(name string, age time.Duration)
 }
 
 // LeaderMetric instruments metrics used in leader election.
@@ -34,6 +40,23 @@ type LeaderMetric interface {
 	SlowpathExercised(name string)
 }
 
+// ElectionMetric is an optional extension of LeaderMetric. If the LeaderMetric
+// created by the MetricsProvider also implements ElectionMetric, it receives
+// these additional hooks.
+type ElectionMetric interface {
+	// AcquireAttempt is called for every attempt to acquire the lease.
+	AcquireAttempt(name string)
+	// RenewLatency is called with the duration of every successful renewal.
+	RenewLatency(name string, latency time.Duration)
+	// RenewFailed is called when the lease could not be renewed in time.
+	RenewFailed(name string)
+	// Transition is called when a change of the leader is observed.
+	Transition(name string)
+	// LeaseAge is called after every successful renewal with the time since
+	// the lease was acquired.
+	LeaseAge(name string, age time.Duration)
+}
+
 type noopMetric struct{}
 
 func (noopMetric) On(name string)                {}
@@ -44,6 +67,8 @@ func (noopMetric) SlowpathExercised(name string) {}
 type defaultLeaderMetrics struct {
 	// leader's value indicates if the current process is the owner of name lease
 	leader LeaderMetric
+	// election is nil if leader does not implement ElectionMetric
+	election ElectionMetric
 }
 
 func (m *defaultLeaderMetrics) leaderOn(name string) {
@@ -67,11 +92,51 @@ func (m *defaultLeaderMetrics) slowpathExercised(name string) {
 	m.leader.SlowpathExercised(name)
 }
 
+func (m *defaultLeaderMetrics) acquireAttempt(name string) {
+	if m == nil || m.election == nil {
+		return
+	}
+	m.election.AcquireAttempt(name)
+}
+
+func (m *defaultLeaderMetrics) renewLatency(name string, latency time.Duration) {
+	if m == nil || m.election == nil {
+		return
+	}
+	m.election.RenewLatency(name, latency)
+}
+
+func (m *defaultLeaderMetrics) renewFailed(name string) {
+	if m == nil || m.election == nil {
+		return
+	}
+	m.election.RenewFailed(name)
+}
+
+func (m *defaultLeaderMetrics) transition(name string) {
+	if m == nil || m.election == nil {
+		return
+	}
+	m.election.Transition(name)
+}
+
+func (m *defaultLeaderMetrics) leaseAge(name string, age time.Duration) {
+	if m == nil || m.election == nil {
+		return
+	}
+	m.election.LeaseAge(name, age)
+}
+
 type noMetrics struct{}
 
-func (noMetrics) leaderOn(name string)          {}
-func (noMetrics) leaderOff(name string)         {}
-func (noMetrics) slowpathExercised(name string) {}
+func (noMetrics) leaderOn(name string)                            {}
+func (noMetrics) leaderOff(name string)                           {}
+func (noMetrics) slowpathExercised(name string)                   {}
+func (noMetrics) acquireAttempt(name string)                      {}
+func (noMetrics) renewLatency(name string, latency time.Duration) {}
+func (noMetrics) renewFailed(name string)                         {}
+func (noMetrics) transition(name string)                          {}
+func (noMetrics) leaseAge(name string, age time.Duration)         {}
 
 // MetricsProvider generates various metrics used by the leader election.
 type MetricsProvider interface {
@@ -105,8 +170,11 @@ func (f *leaderMetricsFactory) newLeaderMetrics() leaderMetricsAdapter {
 	if mp == (noopMetricsProvider{}) {
 		return noMetrics{}
 	}
+	leader := mp.NewLeaderMetric()
+	election, _ := leader.(ElectionMetric)
 	return &defaultLeaderMetrics{
-		leader: mp.NewLeaderMetric(),
+		leader:   leader,
+		election: election,
 	}
 }
 
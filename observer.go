@@ -0,0 +1,220 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+// LeaderObserverConfig configures a LeaderObserver.
+type LeaderObserverConfig struct {
+	// Lock is the resource that will be observed. It is only read, so its
+	// identity may be empty.
+	Lock rl.Interface
+
+	// RetryPeriod is the duration between reads of the record when the lock
+	// does not implement resourcelock.Watcher, or its watch broke.
+	RetryPeriod time.Duration
+
+	// OnNewLeader is called when the observed leader changes. It is called
+	// with the empty string when the record is released or deleted.
+	OnNewLeader func(identity string)
+
+	// Clock can be used to inject a clock. Defaults to the real clock.
+	Clock clock.Clock
+
+	// Name is the name of the observer, used in logs.
+	Name string
+}
+
+// LeaderObserver tracks the leader of an election without taking part in it.
+type LeaderObserver struct {
+	config LeaderObserverConfig
+	clock  clock.Clock
+
+	// lock protects the fields below
+	lock           sync.Mutex
+	observedRecord rl.LeaderElectionRecord
+	observedRaw    []byte
+	observedTime   time.Time
+	reportedLeader string
+	subscribers    map[chan rl.LeaderElectionRecord]struct{}
+}
+
+// NewLeaderObserver creates a LeaderObserver from a LeaderObserverConfig.
+func NewLeaderObserver(loc LeaderObserverConfig) (*LeaderObserver, error) {
+	if loc.Lock == nil {
+		return nil, fmt.Errorf("Lock must not be nil.")
+	}
+	if loc.RetryPeriod < 1 {
+		return nil, fmt.Errorf("retryPeriod must be greater than zero")
+	}
+	if loc.Clock == nil {
+		loc.Clock = clock.RealClock{}
+	}
+	return &LeaderObserver{
+		config:      loc,
+		clock:       loc.Clock,
+		subscribers: map[chan rl.LeaderElectionRecord]struct{}{},
+	}, nil
+}
+
+// Run observes the record until ctx is done. If the lock implements
+// resourcelock.Watcher, changes are picked up from the watch, falling back
+// to reading the record every RetryPeriod while the watch is broken.
+func (lo *LeaderObserver) Run(ctx context.Context) {
+	defer runtime.HandleCrash()
+	defer lo.closeSubscribers()
+
+	watcher, ok := lo.config.Lock.(rl.Watcher)
+	wait.JitterUntil(func() {
+		if !ok {
+			lo.get(ctx)
+			return
+		}
+		if !lo.get(ctx) {
+			return
+		}
+		// the watch resumes from the record read by get
+		watchCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		events := watcher.Watch(watchCtx)
+		for event := range events {
+			lo.observe(event.Record, event.RawRecord)
+		}
+		klog.V(4).Infof("watch of %v broke, reading it every %v", lo.config.Lock.Describe(), lo.config.RetryPeriod)
+	}, lo.config.RetryPeriod, JitterFactor, true, ctx.Done())
+}
+
+// GetLeader returns the identity of the last observed leader or returns the empty string if
+// no leader has yet been observed, or the lease of the observed leader has expired.
+func (lo *LeaderObserver) GetLeader() string {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	if lo.leaseExpired() {
+		return ""
+	}
+	return lo.observedRecord.HolderIdentity
+}
+
+// GetLeaderElectionRecord returns the last observed record, and the time it was observed.
+// The record is returned as observed, even if its lease has expired since.
+func (lo *LeaderObserver) GetLeaderElectionRecord() (rl.LeaderElectionRecord, time.Time) {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	return lo.observedRecord, lo.observedTime
+}
+
+// Subscribe returns a channel that receives the observed record whenever
+// the leader changes, starting with the current one. Slow receivers only
+// get the latest record. The channel is closed once ctx is done or Run
+// returned.
+func (lo *LeaderObserver) Subscribe(ctx context.Context) <-chan rl.LeaderElectionRecord {
+	ch := make(chan rl.LeaderElectionRecord, 1)
+	lo.lock.Lock()
+	lo.subscribers[ch] = struct{}{}
+	if !lo.observedTime.IsZero() {
+		ch <- lo.observedRecord
+	}
+	lo.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		lo.lock.Lock()
+		defer lo.lock.Unlock()
+		if _, ok := lo.subscribers[ch]; ok {
+			delete(lo.subscribers, ch)
+			close(ch)
+		}
+	}()
+	return ch
+}
+
+// get reads the record and observes it. Returns false if it failed.
+func (lo *LeaderObserver) get(ctx context.Context) bool {
+	record, raw, err := lo.config.Lock.Get(ctx)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			klog.Errorf("error retrieving resource lock %v: %v", lo.config.Lock.Describe(), err)
+			return false
+		}
+		record, raw = nil, nil
+	}
+	lo.observe(record, raw)
+	return true
+}
+
+// observe records the observed record, nil if it does not exist, and
+// reports a change of the leader.
+func (lo *LeaderObserver) observe(record *rl.LeaderElectionRecord, raw []byte) {
+	if record == nil {
+		record = &rl.LeaderElectionRecord{}
+	}
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	first := lo.observedTime.IsZero()
+	if !first && bytes.Equal(lo.observedRaw, raw) {
+		return
+	}
+	lo.observedRecord = *record
+	lo.observedRaw = raw
+	lo.observedTime = lo.clock.Now()
+	if record.HolderIdentity != lo.reportedLeader {
+		lo.reportedLeader = record.HolderIdentity
+		klog.V(4).Infof("%v observed new leader %q", lo.config.Name, lo.reportedLeader)
+		if lo.config.OnNewLeader != nil {
+			go lo.config.OnNewLeader(lo.reportedLeader)
+		}
+	} else if !first {
+		return
+	}
+	for ch := range lo.subscribers {
+		// drop the stale record a slow receiver has not taken yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- *record
+	}
+}
+
+// leaseExpired reports whether the lease of the observed record expired, as
+// it was not renewed within LeaseDurationSeconds of being observed. The
+// caller must hold lo.lock.
+func (lo *LeaderObserver) leaseExpired() bool {
+	leaseDuration := time.Duration(lo.observedRecord.LeaseDurationSeconds) * time.Second
+	return lo.clock.Since(lo.observedTime) > leaseDuration
+}
+
+// closeSubscribers closes all subscribed channels.
+func (lo *LeaderObserver) closeSubscribers() {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	for ch := range lo.subscribers {
+		delete(lo.subscribers, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+	"github.com/khh403/leaderelection/resourcelock/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestLeaderObserverLeaseExpiry(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	leader := fake.NewLock(store, "a")
+	record := rl.LeaderElectionRecord{
+		HolderIdentity:       "a",
+		LeaseDurationSeconds: 10,
+		HolderMetadata:       map[string]string{rl.MetadataAddress: "10.0.0.1:8080"},
+	}
+	if err := leader.Create(context.Background(), record); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	lo, err := NewLeaderObserver(LeaderObserverConfig{
+		Lock:        fake.NewLock(store, ""),
+		RetryPeriod: time.Second,
+		Clock:       clock,
+	})
+	if err != nil {
+		t.Fatalf("error creating observer: %v", err)
+	}
+
+	if got := lo.GetLeader(); got != "" {
+		t.Errorf("expected no leader before observing the record, got %q", got)
+	}
+	lo.get(context.Background())
+	if got := lo.GetLeader(); got != "a" {
+		t.Errorf("expected leader a, got %q", got)
+	}
+	if info := lo.GetLeaderInfo(); info.Identity != "a" || info.Address() != "10.0.0.1:8080" {
+		t.Errorf("expected the info of a, got %+v", info)
+	}
+
+	// the leader stops renewing, the record stays unchanged
+	clock.Step(11 * time.Second)
+	lo.get(context.Background())
+	if got := lo.GetLeader(); got != "" {
+		t.Errorf("expected no leader once the lease expired, got %q", got)
+	}
+	if info := lo.GetLeaderInfo(); info.Identity != "" || info.Address() != "" {
+		t.Errorf("expected no leader info once the lease expired, got %+v", info)
+	}
+	if observed, _ := lo.GetLeaderElectionRecord(); observed.HolderIdentity != "a" {
+		t.Errorf("expected the expired record to be returned as observed, got %+v", observed)
+	}
+
+	// a renewal makes the leader valid again
+	record.RenewTime.Time = clock.Now()
+	if err := leader.Update(context.Background(), record); err != nil {
+		t.Fatalf("error renewing record: %v", err)
+	}
+	lo.get(context.Background())
+	if got := lo.GetLeader(); got != "a" {
+		t.Errorf("expected leader a after the renewal, got %q", got)
+	}
+}
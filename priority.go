@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"context"
+	"fmt"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Candidates with a priority register with locks implementing
+// resourcelock.CandidateRegistry. A candidate does not acquire a free or
+// expired lease while a live candidate with a higher priority exists, and
+// with Preempt it asks a leader with a lower priority to hand over
+// leadership by setting itself as the preferred holder of the record.
+
+// registerCandidate registers this client with the candidate registry of the
+// lock until ctx is done, if it has a priority or the election is coordinated.
+func (le *LeaderElector) registerCandidate(ctx context.Context) {
+	registry, ok := le.config.Lock.(rl.CandidateRegistry)
+	if !ok || (registry.Candidate().Priority == 0 && !le.config.Coordinated) {
+		return
+	}
+	go wait.PollImmediateUntil(le.config.RetryPeriod, func() (bool, error) {
+		if err := registry.Register(ctx, le.config.LeaseDuration); err != nil {
+			klog.Errorf("error registering candidate for %v: %v", le.config.Lock.Describe(), err)
+			return false, nil
+		}
+		return true, nil
+	}, ctx.Done())
+}
+
+// mayAcquire returns errLeaseHeld if this client has to leave a free or
+// expired lease to another candidate: in coordinated mode to the candidate
+// picked by the strategy, otherwise to a live candidate with a higher
+// priority.
+func (le *LeaderElector) mayAcquire(ctx context.Context) error {
+	if le.config.Coordinated {
+		pick, err := le.pickLeader(ctx, "")
+		if err != nil {
+			return fmt.Errorf("error picking leader of %v: %w", le.config.Lock.Describe(), err)
+		}
+		if pick != le.config.Lock.Identity() {
+			klog.V(4).Infof("deferring to candidate %v picked by the strategy", pick)
+			return errLeaseHeld
+		}
+		return nil
+	}
+	if identity, ok := le.higherPriorityCandidate(ctx); ok {
+		klog.V(4).Infof("deferring to candidate %v with a higher priority", identity)
+		return errLeaseHeld
+	}
+	return nil
+}
+
+// priorities returns the priorities of the live candidates by identity, and
+// the priority of this client. ok is false if they are not known.
+func (le *LeaderElector) priorities(ctx context.Context) (priorities map[string]int, own int, ok bool) {
+	registry, ok := le.config.Lock.(rl.CandidateRegistry)
+	if !ok {
+		return nil, 0, false
+	}
+	candidates, err := registry.Candidates(ctx)
+	if err != nil {
+		klog.Errorf("error listing candidates of %v: %v", le.config.Lock.Describe(), err)
+		return nil, 0, false
+	}
+	priorities = make(map[string]int, len(candidates))
+	for _, candidate := range candidates {
+		priorities[candidate.Identity] = candidate.Priority
+	}
+	return priorities, registry.Candidate().Priority, true
+}
+
+// higherPriorityCandidate returns a live candidate with a higher priority
+// than this client, if any.
+func (le *LeaderElector) higherPriorityCandidate(ctx context.Context) (string, bool) {
+	priorities, own, ok := le.priorities(ctx)
+	if !ok {
+		return "", false
+	}
+	for identity, priority := range priorities {
+		if priority > own {
+			return identity, true
+		}
+	}
+	return "", false
+}
+
+// outranks reports whether the live candidate identity has a higher priority
+// than the holder. Unregistered candidates have a zero priority.
+func (le *LeaderElector) outranks(ctx context.Context, identity, holder string) bool {
+	priorities, own, ok := le.priorities(ctx)
+	if !ok {
+		return false
+	}
+	priorities[le.config.Lock.Identity()] = own
+	priority, live := priorities[identity]
+	return live && priority > priorities[holder]
+}
+
+// requestYield asks the holder of record to hand over leadership to this
+// client, if preemption is enabled and this client has a higher priority.
+func (le *LeaderElector) requestYield(ctx context.Context, record *rl.LeaderElectionRecord) {
+	identity := le.config.Lock.Identity()
+	if !le.config.Preempt || record.PreferredHolder == identity {
+		return
+	}
+	if !le.outranks(ctx, identity, record.HolderIdentity) {
+		return
+	}
+
+	request := *record
+	request.PreferredHolder = identity
+	if err := le.config.Lock.Update(ctx, request); err != nil {
+		klog.V(4).Infof("failed to ask %v to yield lease %v: %v", record.HolderIdentity, le.config.Lock.Describe(), err)
+		return
+	}
+	klog.Infof("asked %v to yield lease %v", record.HolderIdentity, le.config.Lock.Describe())
+}
+
+// yieldRequested reports whether the record of a lease held by this client
+// asks it to hand over leadership to a candidate with a higher priority.
+func (le *LeaderElector) yieldRequested(ctx context.Context, record *rl.LeaderElectionRecord) bool {
+	if le.isPreferredHolder(record) {
+		return false
+	}
+	return le.outranks(ctx, record.PreferredHolder, le.config.Lock.Identity())
+}
@@ -0,0 +1,184 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+	"github.com/khh403/leaderelection/resourcelock/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// candidates is a candidate registry shared by the locks of an election.
+type candidates struct {
+	lock sync.Mutex
+	live map[string]rl.Candidate
+}
+
+func newCandidates() *candidates {
+	return &candidates{live: map[string]rl.Candidate{}}
+}
+
+func (c *candidates) set(candidate rl.Candidate) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.live[candidate.Identity] = candidate
+}
+
+func (c *candidates) remove(identity string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.live, identity)
+}
+
+// candidateLock is a fake lock registering its candidate with a shared
+// registry.
+type candidateLock struct {
+	*fake.Lock
+	candidate rl.Candidate
+	registry  *candidates
+}
+
+func newCandidateLock(store *fake.Store, registry *candidates, candidate rl.Candidate) *candidateLock {
+	return &candidateLock{
+		Lock:      fake.NewLock(store, candidate.Identity),
+		candidate: candidate,
+		registry:  registry,
+	}
+}
+
+func (l *candidateLock) Register(ctx context.Context, ttl time.Duration) error {
+	l.registry.set(l.candidate)
+	go func() {
+		<-ctx.Done()
+		l.registry.remove(l.candidate.Identity)
+	}()
+	return nil
+}
+
+func (l *candidateLock) Candidates(ctx context.Context) ([]rl.Candidate, error) {
+	l.registry.lock.Lock()
+	defer l.registry.lock.Unlock()
+	var live []rl.Candidate
+	for _, candidate := range l.registry.live {
+		live = append(live, candidate)
+	}
+	return live, nil
+}
+
+func (l *candidateLock) Candidate() rl.Candidate {
+	return l.candidate
+}
+
+func TestMayAcquireDefersToHigherPriorityCandidate(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	registry := newCandidates()
+	le := newTestElector(t, newCandidateLock(store, registry, rl.Candidate{Identity: "a", Priority: 1}), clock)
+	registry.set(rl.Candidate{Identity: "a", Priority: 1})
+	registry.set(rl.Candidate{Identity: "b", Priority: 2})
+
+	if err := le.tryAcquireOrRenew(context.Background()); !errors.Is(err, errLeaseHeld) {
+		t.Fatalf("expected errLeaseHeld while b is live, got %v", err)
+	}
+	if record := store.Record(); record != nil {
+		t.Fatalf("expected the lease to stay free, got holder %q", record.HolderIdentity)
+	}
+
+	registry.remove("b")
+	if err := le.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("error acquiring the lease once b left: %v", err)
+	}
+	if holder := store.Record().HolderIdentity; holder != "a" {
+		t.Errorf("expected a to hold the lease, got %q", holder)
+	}
+}
+
+func TestPreemptRequestsYield(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	registry := newCandidates()
+	leader := newTestElector(t, newCandidateLock(store, registry, rl.Candidate{Identity: "a", Priority: 1}), clock)
+	registry.set(rl.Candidate{Identity: "a", Priority: 1})
+	if err := leader.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("error acquiring the lease: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		preempt bool
+		want    string
+	}{
+		{"without preemption", false, ""},
+		{"with preemption", true, "b"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			le := newTestElector(t, newCandidateLock(store, registry, rl.Candidate{Identity: "b", Priority: 2}), clock)
+			le.config.Preempt = test.preempt
+			registry.set(rl.Candidate{Identity: "b", Priority: 2})
+
+			if err := le.tryAcquireOrRenew(context.Background()); !errors.Is(err, errLeaseHeld) {
+				t.Fatalf("expected errLeaseHeld while a leads, got %v", err)
+			}
+			record := store.Record()
+			if record.HolderIdentity != "a" {
+				t.Errorf("expected a to keep holding the lease, got %q", record.HolderIdentity)
+			}
+			if record.PreferredHolder != test.want {
+				t.Errorf("expected preferred holder %q, got %q", test.want, record.PreferredHolder)
+			}
+		})
+	}
+}
+
+func TestLeaderYieldsToPreferredHolder(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	store := fake.NewStore()
+	registry := newCandidates()
+	le := newTestElector(t, newCandidateLock(store, registry, rl.Candidate{Identity: "a", Priority: 1}), clock)
+	metrics := &recordingMetrics{}
+	le.metrics = metrics
+	result := runLeading(t, context.Background(), le)
+
+	candidate := newTestElector(t, newCandidateLock(store, registry, rl.Candidate{Identity: "b", Priority: 2}), clock)
+	candidate.config.Preempt = true
+	registry.set(rl.Candidate{Identity: "b", Priority: 2})
+	if err := candidate.tryAcquireOrRenew(context.Background()); !errors.Is(err, errLeaseHeld) {
+		t.Fatalf("expected errLeaseHeld while a leads, got %v", err)
+	}
+
+	if err := waitResult(t, result); !errors.Is(err, ErrLeadershipTransferred) {
+		t.Errorf("expected ErrLeadershipTransferred, got %v", err)
+	}
+	if _, failures := metrics.get(); failures != 0 {
+		t.Errorf("expected the yield not to count as a failed renewal, got %d", failures)
+	}
+	record := store.Record()
+	if record.HolderIdentity != "" || record.PreferredHolder != "b" {
+		t.Fatalf("expected the lease to be handed over to b, got holder %q preferred %q", record.HolderIdentity, record.PreferredHolder)
+	}
+	if err := candidate.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("error acquiring the handed over lease: %v", err)
+	}
+	if holder := store.Record().HolderIdentity; holder != "b" {
+		t.Errorf("expected b to hold the lease, got %q", holder)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+// Package prometheus provides a leaderelection.MetricsProvider exporting
+// leader election metrics to Prometheus.
+//
+// Register it before creating any LeaderElector:
+//
+//	provider, err := prometheus.NewMetricsProvider(registry)
+//	if err != nil {
+//		...
+//	}
+//	leaderelection.SetProvider(provider)
+package prometheus
+
+import (
+	"time"
+
+	"github.com/khh403/leaderelection"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const subsystem = "leader_election"
+
+// MetricsProvider creates LeaderMetrics backed by Prometheus collectors. All
+// LeaderMetrics share the same collectors, labelled by the election name.
+type MetricsProvider struct {
+	masterStatus    *prometheus.GaugeVec
+	slowpath        *prometheus.CounterVec
+	acquireAttempts *prometheus.CounterVec
+	renewDuration   *prometheus.HistogramVec
+	renewFailures   *prometheus.CounterVec
+	transitions     *prometheus.CounterVec
+	leaseAge        *prometheus.GaugeVec
+}
+
+var _ leaderelection.MetricsProvider = &MetricsProvider{}
+
+// NewMetricsProvider creates a MetricsProvider and registers its collectors
+// with registerer.
+func NewMetricsProvider(registerer prometheus.Registerer) (*MetricsProvider, error) {
+	labels := []string{"name"}
+	p := &MetricsProvider{
+		masterStatus: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: subsystem,
+			Name:      "master_status",
+			Help:      "Gauge of if the reporting system is master of the relevant lease, 0 indicates backup, 1 indicates master.",
+		}, labels),
+		slowpath: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: subsystem,
+			Name:      "slowpath_total",
+			Help:      "Total number of slow path exercised in renewing leader leases.",
+		}, labels),
+		acquireAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: subsystem,
+			Name:      "acquire_attempts_total",
+			Help:      "Total number of attempts to acquire the lease.",
+		}, labels),
+		renewDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Subsystem: subsystem,
+			Name:      "renew_duration_seconds",
+			Help:      "Latency of successful lease renewals in seconds.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+		}, labels),
+		renewFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: subsystem,
+			Name:      "renew_failures_total",
+			Help:      "Total number of times the lease could not be renewed within the renew deadline.",
+		}, labels),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: subsystem,
+			Name:      "transitions_total",
+			Help:      "Total number of observed leader changes.",
+		}, labels),
+		leaseAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: subsystem,
+			Name:      "lease_age_seconds",
+			Help:      "Time since the lease held by the reporting system was acquired, 0 if it is not master.",
+		}, labels),
+	}
+
+	for _, c := range []prometheus.Collector{
+		p.masterStatus,
+		p.slowpath,
+		p.acquireAttempts,
+		p.renewDuration,
+		p.renewFailures,
+		p.transitions,
+		p.leaseAge,
+	} {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// NewLeaderMetric returns a LeaderMetric that also implements
+// leaderelection.ElectionMetric.
+func (p *MetricsProvider) NewLeaderMetric() leaderelection.LeaderMetric {
+	return &leaderMetric{p}
+}
+
+type leaderMetric struct {
+	*MetricsProvider
+}
+
+var _ leaderelection.ElectionMetric = &leaderMetric{}
+
+func (m *leaderMetric) On(name string) {
+	m.masterStatus.WithLabelValues(name).Set(1)
+}
+
+func (m *leaderMetric) Off(name string) {
+	m.masterStatus.WithLabelValues(name).Set(0)
+	m.leaseAge.WithLabelValues(name).Set(0)
+}
+
+func (m *leaderMetric) SlowpathExercised(name string) {
+	m.slowpath.WithLabelValues(name).Inc()
+}
+
+func (m *leaderMetric) AcquireAttempt(name string) {
+	m.acquireAttempts.WithLabelValues(name).Inc()
+}
+
+func (m *leaderMetric) RenewLatency(name string, latency time.Duration) {
+	m.renewDuration.WithLabelValues(name).Observe(latency.Seconds())
+}
+
+func (m *leaderMetric) RenewFailed(name string) {
+	m.renewFailures.WithLabelValues(name).Inc()
+}
+
+func (m *leaderMetric) Transition(name string) {
+	m.transitions.WithLabelValues(name).Inc()
+}
+
+func (m *leaderMetric) LeaseAge(name string, age time.Duration) {
+	m.leaseAge.WithLabelValues(name).Set(age.Seconds())
+}
@@ -0,0 +1,239 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+// Package fake provides an in-memory resourcelock.Interface for unit testing
+// code that runs leader election.
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/clock"
+)
+
+// Op identifies an operation of the lock for error injection.
+type Op string
+
+const (
+	OpGet    Op = "get"
+	OpCreate Op = "create"
+	OpUpdate Op = "update"
+)
+
+// Store holds the election record shared by the locks of all candidates
+// taking part in one election.
+type Store struct {
+	mu       sync.Mutex
+	record   *rl.LeaderElectionRecord
+	revision int64
+}
+
+// NewStore creates an empty Store.
+func NewStore() *Store {
+	return &Store{}
+}
+
+// Record returns a copy of the stored election record, or nil if no record
+// has been created yet.
+func (s *Store) Record() *rl.LeaderElectionRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.record == nil {
+		return nil
+	}
+	record := *s.record
+	return &record
+}
+
+// Lock is an in-memory, thread-safe resourcelock.Interface backed by a
+// Store. Create and Update are compare-and-swap operations like those of
+// resourcelock.LeaseLock, and errors and latency can be injected per lock.
+type Lock struct {
+	store    *Store
+	identity string
+
+	mu sync.Mutex
+	// revision of the store last observed by this lock
+	revision int64
+	errs     map[Op]error
+	latency  time.Duration
+	clock    clock.Clock
+	events   []string
+}
+
+var _ rl.Interface = &Lock{}
+var _ rl.Revisioner = &Lock{}
+
+// NewLock creates a Lock for the candidate identity on store.
+func NewLock(store *Store, identity string) *Lock {
+	return &Lock{
+		store:    store,
+		identity: identity,
+		errs:     map[Op]error{},
+		clock:    clock.RealClock{},
+	}
+}
+
+// SetError makes every following op fail with err. A nil err clears the
+// injected error.
+func (l *Lock) SetError(op Op, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil {
+		delete(l.errs, op)
+		return
+	}
+	l.errs[op] = err
+}
+
+// SetLatency delays every following operation by latency, as measured by the
+// clock of the lock, or until the context of the operation is done.
+func (l *Lock) SetLatency(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.latency = latency
+}
+
+// SetClock sets the clock the injected latency is measured by. It defaults to
+// the real clock.
+func (l *Lock) SetClock(clock clock.Clock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = clock
+}
+
+// Events returns the events recorded by RecordEvent.
+func (l *Lock) Events() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+// Get returns the election record of the store
+func (l *Lock) Get(ctx context.Context) (*rl.LeaderElectionRecord, []byte, error) {
+	if err := l.begin(ctx, OpGet); err != nil {
+		return nil, nil, err
+	}
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+	if l.store.record == nil {
+		return nil, nil, apierrors.NewNotFound(schema.GroupResource{}, "not found")
+	}
+
+	record := *l.store.record
+	recordByte, err := json.Marshal(record)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.observe(l.store.revision)
+	return &record, recordByte, nil
+}
+
+// Create stores ler if the store holds no record yet
+func (l *Lock) Create(ctx context.Context, ler rl.LeaderElectionRecord) error {
+	if err := l.begin(ctx, OpCreate); err != nil {
+		return err
+	}
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+	if l.store.record != nil {
+		return rl.ErrConflict
+	}
+
+	l.store.record = &ler
+	l.store.revision++
+	l.observe(l.store.revision)
+	return nil
+}
+
+// Update stores ler if the record was not modified since this lock last
+// observed it
+func (l *Lock) Update(ctx context.Context, ler rl.LeaderElectionRecord) error {
+	if err := l.begin(ctx, OpUpdate); err != nil {
+		return err
+	}
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+	if l.store.record == nil {
+		return apierrors.NewNotFound(schema.GroupResource{}, "not found")
+	}
+	l.mu.Lock()
+	revision := l.revision
+	l.mu.Unlock()
+	if revision != l.store.revision {
+		return rl.ErrConflict
+	}
+
+	l.store.record = &ler
+	l.store.revision++
+	l.observe(l.store.revision)
+	return nil
+}
+
+// RecordEvent records s, see Events
+func (l *Lock) RecordEvent(s string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, fmt.Sprintf("%v %v", l.identity, s))
+}
+
+// Identity returns the Identity of the lock
+func (l *Lock) Identity() string {
+	return l.identity
+}
+
+// Describe is used to convert details on current resource lock
+// into a string
+func (l *Lock) Describe() string {
+	return fmt.Sprintf("fake/%v", l.identity)
+}
+
+// Revision returns the revision of the store as last observed by this lock.
+func (l *Lock) Revision() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.revision
+}
+
+// begin applies the injected latency and error of op.
+func (l *Lock) begin(ctx context.Context, op Op) error {
+	l.mu.Lock()
+	latency, clock, err := l.latency, l.clock, l.errs[op]
+	l.mu.Unlock()
+
+	if latency > 0 {
+		timer := clock.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C():
+		}
+	}
+	return err
+}
+
+// observe records revision as the last revision observed by this lock.
+func (l *Lock) observe(revision int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.revision = revision
+}
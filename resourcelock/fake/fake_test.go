@@ -0,0 +1,86 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package fake
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestLatencyFollowsClock(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	lock := NewLock(NewStore(), "a")
+	lock.SetClock(clock)
+	lock.SetLatency(time.Minute)
+
+	result := make(chan error, 1)
+	go func() { result <- lock.Create(context.Background(), rl.LeaderElectionRecord{HolderIdentity: "a"}) }()
+	for !clock.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-result:
+		t.Fatalf("create returned before the latency passed: %v", err)
+	default:
+	}
+
+	clock.Step(time.Minute)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("error creating record: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("create did not return after the latency passed")
+	}
+}
+
+func TestLatencyCancelled(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	lock := NewLock(NewStore(), "a")
+	lock.SetClock(clock)
+	lock.SetLatency(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := lock.Get(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	store := NewStore()
+	a, b := NewLock(store, "a"), NewLock(store, "b")
+	ctx := context.Background()
+	if err := a.Create(ctx, rl.LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	if err := b.Create(ctx, rl.LeaderElectionRecord{HolderIdentity: "b"}); !rl.IsConflict(err) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if _, _, err := b.Get(ctx); err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if err := a.Update(ctx, rl.LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error renewing record: %v", err)
+	}
+	if err := b.Update(ctx, rl.LeaderElectionRecord{HolderIdentity: "b"}); !rl.IsConflict(err) {
+		t.Fatalf("expected ErrConflict updating a stale record, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+//go:build unix && !aix && !solaris
+
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// flockRetryPeriod is the interval at which a flock held by another process
+// is tried again.
+const flockRetryPeriod = 10 * time.Millisecond
+
+// FileLock stores the election record in a file, for candidates running on
+// the same host. Accesses are serialized with flock on the lock file
+// Path+".lock", and the record file is replaced atomically by renaming a
+// temporary file. Every write increments the revision stored with the
+// record, which makes Update a compare-and-swap.
+type FileLock struct {
+	// Path is the file the record is stored in.
+	Path       string
+	LockConfig ResourceLockConfig
+	// revision is the revision of the last observed record, 0 if none.
+	revision int64
+}
+
+// fileRecord is the content of the record file.
+type fileRecord struct {
+	Revision int64                `json:"revision"`
+	Record   LeaderElectionRecord `json:"record"`
+}
+
+// Get returns the election record from the file
+func (fl *FileLock) Get(ctx context.Context) (*LeaderElectionRecord, []byte, error) {
+	var fr *fileRecord
+	err := fl.withLock(ctx, syscall.LOCK_SH, func() error {
+		var err error
+		fr, err = fl.read()
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if fr == nil {
+		return nil, nil, apierrors.NewNotFound(schema.GroupResource{}, "not found")
+	}
+	recordByte, err := json.Marshal(fr.Record)
+	if err != nil {
+		return nil, nil, err
+	}
+	fl.revision = fr.Revision
+	return &fr.Record, recordByte, nil
+}
+
+// Create attempts to create the record file. It fails with ErrConflict if
+// the file already exists.
+func (fl *FileLock) Create(ctx context.Context, ler LeaderElectionRecord) error {
+	return fl.withLock(ctx, syscall.LOCK_EX, func() error {
+		fr, err := fl.read()
+		if err != nil {
+			return err
+		}
+		if fr != nil {
+			return ErrConflict
+		}
+		return fl.write(&fileRecord{Revision: 1, Record: ler})
+	})
+}
+
+// Update will update the existing record. It fails with ErrConflict if the
+// record was modified since it was last observed by Get, Create or Update.
+func (fl *FileLock) Update(ctx context.Context, ler LeaderElectionRecord) error {
+	if fl.revision == 0 {
+		return errors.New("record not initialized, call get or create first")
+	}
+	return fl.withLock(ctx, syscall.LOCK_EX, func() error {
+		fr, err := fl.read()
+		if err != nil {
+			return err
+		}
+		if fr == nil || fr.Revision != fl.revision {
+			return ErrConflict
+		}
+		return fl.write(&fileRecord{Revision: fr.Revision + 1, Record: ler})
+	})
+}
+
+// withLock runs f holding the flock of how on the lock file. It retries
+// taking a flock held by another process until ctx is done.
+func (fl *FileLock) withLock(ctx context.Context, how int, f func() error) error {
+	file, err := os.OpenFile(fl.Path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for {
+		err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("error locking %v: %w", file.Name(), ctx.Err())
+		case <-time.After(flockRetryPeriod):
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error locking %v: %w", file.Name(), err)
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return f()
+}
+
+// read reads the record file, nil if it does not exist.
+func (fl *FileLock) read() (*fileRecord, error) {
+	data, err := os.ReadFile(fl.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var fr fileRecord
+	if err := json.Unmarshal(data, &fr); err != nil {
+		return nil, fmt.Errorf("error decoding %v: %w", fl.Path, err)
+	}
+	return &fr, nil
+}
+
+// write replaces the record file with fr and observes its revision.
+func (fl *FileLock) write(fr *fileRecord) error {
+	data, err := json.Marshal(fr)
+	if err != nil {
+		return err
+	}
+	dir, base := filepath.Split(fl.Path)
+	tmp, err := os.CreateTemp(dir, base+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fl.Path); err != nil {
+		return err
+	}
+	fl.revision = fr.Revision
+	return nil
+}
+
+// RecordEvent in leader election while adding meta-data
+func (fl *FileLock) RecordEvent(s string) {
+	if fl.LockConfig.EventRecorder == nil {
+		return
+	}
+	events := fmt.Sprintf("%v %v", fl.LockConfig.Identity, s)
+	subject := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: filepath.Base(fl.Path)}}
+	// Populate the type meta, so we don't have to get it from the schema
+	subject.Kind = "Lease"
+	subject.APIVersion = coordinationv1.SchemeGroupVersion.String()
+	fl.LockConfig.EventRecorder.Eventf(subject, corev1.EventTypeNormal, "LeaderElection", events)
+}
+
+// Describe is used to convert details on current resource lock
+// into a string
+func (fl *FileLock) Describe() string {
+	return fl.Path
+}
+
+// Identity returns the Identity of the lock
+func (fl *FileLock) Identity() string {
+	return fl.LockConfig.Identity
+}
+
+// Metadata returns the metadata advertised while holding the lock.
+func (fl *FileLock) Metadata() map[string]string {
+	return fl.LockConfig.Metadata
+}
+
+// Revision returns the revision of the record as last read or written by
+// this lock.
+func (fl *FileLock) Revision() int64 {
+	return fl.revision
+}
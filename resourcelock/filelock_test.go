@@ -0,0 +1,156 @@
+//go:build unix && !aix && !solaris
+
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+func newTestFileLock(path, identity string) *FileLock {
+	return &FileLock{
+		Path:       path,
+		LockConfig: ResourceLockConfig{Identity: identity},
+	}
+}
+
+func TestFileLockCreateConflict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	ctx := context.Background()
+	a := newTestFileLock(path, "a")
+	if _, _, err := a.Get(ctx); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected NotFound before the record is created, got %v", err)
+	}
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	b := newTestFileLock(path, "b")
+	if err := b.Create(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict creating an existing record, got %v", err)
+	}
+	if record, _, err := b.Get(ctx); err != nil || record.HolderIdentity != "a" {
+		t.Errorf("expected the record of a to be kept, got %+v, %v", record, err)
+	}
+}
+
+func TestFileLockStaleUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	ctx := context.Background()
+	a := newTestFileLock(path, "a")
+	b := newTestFileLock(path, "b")
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "b"}); err == nil {
+		t.Errorf("expected an update before Get to fail")
+	}
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	if _, _, err := b.Get(ctx); err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaderTransitions: 1}); err != nil {
+		t.Fatalf("error renewing record: %v", err)
+	}
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict updating a stale revision, got %v", err)
+	}
+	record, _, err := b.Get(ctx)
+	if err != nil || record.HolderIdentity != "a" || record.LeaderTransitions != 1 {
+		t.Errorf("expected the renewed record of a to be kept, got %+v, %v", record, err)
+	}
+	if a.Revision() != 2 || b.Revision() != 2 {
+		t.Errorf("expected revision 2, got %v and %v", a.Revision(), b.Revision())
+	}
+}
+
+func TestFileLockConcurrentUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	ctx := context.Background()
+	if err := newTestFileLock(path, "creator").Create(ctx, LeaderElectionRecord{}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+
+	const candidates = 8
+	locks := make([]*FileLock, candidates)
+	for i := range locks {
+		locks[i] = newTestFileLock(path, string(rune('a'+i)))
+		if _, _, err := locks[i].Get(ctx); err != nil {
+			t.Fatalf("error reading record: %v", err)
+		}
+	}
+	errs := make([]error, candidates)
+	var wg sync.WaitGroup
+	for i, lock := range locks {
+		wg.Add(1)
+		go func(i int, lock *FileLock) {
+			defer wg.Done()
+			errs[i] = lock.Update(ctx, LeaderElectionRecord{HolderIdentity: lock.Identity()})
+		}(i, lock)
+	}
+	wg.Wait()
+
+	winner := ""
+	for i, err := range errs {
+		switch {
+		case err == nil && winner != "":
+			t.Errorf("both %v and %v updated the same revision", winner, locks[i].Identity())
+		case err == nil:
+			winner = locks[i].Identity()
+		case !IsConflict(err):
+			t.Errorf("expected ErrConflict for %v, got %v", locks[i].Identity(), err)
+		}
+	}
+	if winner == "" {
+		t.Fatalf("expected one update to win")
+	}
+	record, _, err := newTestFileLock(path, "reader").Get(ctx)
+	if err != nil || record.HolderIdentity != winner {
+		t.Errorf("expected the record of %v, got %+v, %v", winner, record, err)
+	}
+}
+
+func TestFileLockHonoursContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("error opening lock file: %v", err)
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatalf("error locking: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := newTestFileLock(path, "a").Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the held flock to fail with the context, got %v", err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		t.Fatalf("error unlocking: %v", err)
+	}
+	if _, _, err := newTestFileLock(path, "a").Get(context.Background()); !apierrors.IsNotFound(err) {
+		t.Errorf("expected NotFound once the flock is free, got %v", err)
+	}
+}
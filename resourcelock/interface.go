@@ -16,17 +16,50 @@ package resourcelock
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
 )
 
 const (
 	LeaderElectionRecordAnnotationKey = "github.com/leaderelection/leader"
-	LeasesResourceLock                = "leases"
+	PreferredHolderAnnotationKey      = "github.com/leaderelection/preferred-holder"
+	HolderMetadataAnnotationKey       = "github.com/leaderelection/holder-metadata"
+	// CandidatesKeySegment separates the key of a lock from the keys of
+	// its registered candidates.
+	CandidatesKeySegment = "candidates"
+	// LeasesResourceLock stores the record in etcd, see LeaseLock.
+	LeasesResourceLock = "leases"
+	// KubeLeasesResourceLock stores the record in a Lease of the Kubernetes
+	// API, see KubeLeaseLock.
+	KubeLeasesResourceLock = "kubeleases"
 )
 
+// Well-known keys of the metadata advertised by the holder of a lock.
+const (
+	// MetadataAddress is the address, host:port, the holder serves on.
+	MetadataAddress = "address"
+	// MetadataGRPCPort is the port the holder serves gRPC on.
+	MetadataGRPCPort = "grpcPort"
+	// MetadataVersion is the version of the holder.
+	MetadataVersion = "version"
+)
+
+// ErrConflict is returned by Create and Update when the record was changed by
+// another candidate since it was last observed, i.e. this candidate lost the
+// race for the lock.
+var ErrConflict = errors.New("leader election record was modified concurrently")
+
+// IsConflict reports whether err indicates a lost race for the lock.
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
+
 // LeaderElectionRecord is the record that is stored in the leader election annotation.
 // This information should be used for observational purposes only and could be replaced
 // with a random string (e.g. UUID) with only slight modification of this code.
@@ -41,6 +74,14 @@ type LeaderElectionRecord struct {
 	AcquireTime          metav1.Time `json:"acquireTime"`
 	RenewTime            metav1.Time `json:"renewTime"`
 	LeaderTransitions    int         `json:"leaderTransitions"`
+	// PreferredHolder is set when the holder hands over leadership to another
+	// candidate. While the lease is valid, only PreferredHolder may acquire it.
+	// If HolderIdentity is set as well, PreferredHolder asks the holder to
+	// hand over leadership to it.
+	PreferredHolder string `json:"preferredHolder,omitempty"`
+	// HolderMetadata is the metadata advertised by the holder, e.g. the
+	// address followers forward requests to.
+	HolderMetadata map[string]string `json:"holderMetadata,omitempty"`
 }
 
 // EventRecorder records a change in the ResourceLock.
@@ -56,6 +97,25 @@ type ResourceLockConfig struct {
 	Identity string
 	// EventRecorder is optional.
 	EventRecorder EventRecorder
+	// Priority ranks the candidate against the other candidates of the
+	// election, higher values are preferred. Candidates with a non-zero
+	// priority register themselves with locks implementing
+	// CandidateRegistry.
+	Priority int
+	// BinaryVersion is the version of the binary running the candidate,
+	// advertised to coordinated elections.
+	BinaryVersion string
+	// Metadata is advertised in the election record while this candidate
+	// holds the lock, see the Metadata* keys. Optional.
+	Metadata map[string]string
+}
+
+// Candidate describes a live candidate of an election.
+type Candidate struct {
+	Identity      string      `json:"identity"`
+	Priority      int         `json:"priority"`
+	BinaryVersion string      `json:"binaryVersion,omitempty"`
+	StartTime     metav1.Time `json:"startTime"`
 }
 
 // Interface offers a common interface for locking on arbitrary
@@ -67,10 +127,12 @@ type Interface interface {
 	// Get returns the LeaderElectionRecord
 	Get(ctx context.Context) (*LeaderElectionRecord, []byte, error)
 
-	// Create attempts to create a LeaderElectionRecord
+	// Create attempts to create a LeaderElectionRecord. It returns
+	// ErrConflict if the record already exists.
 	Create(ctx context.Context, ler LeaderElectionRecord) error
 
-	// Update will update and existing LeaderElectionRecord
+	// Update will update and existing LeaderElectionRecord. It returns
+	// ErrConflict if the record changed since it was last observed.
 	Update(ctx context.Context, ler LeaderElectionRecord) error
 
 	// RecordEvent is used to record events
@@ -84,6 +146,61 @@ type Interface interface {
 	Describe() string
 }
 
+// WatchEvent describes a change of the election record observed by a Watcher.
+type WatchEvent struct {
+	// Record is the changed election record, nil if the record was deleted.
+	Record *LeaderElectionRecord
+	// RawRecord is the raw form of Record as it would be returned by Get.
+	RawRecord []byte
+}
+
+// Watcher is an optional interface implemented by locks that can notify
+// about changes of the election record, so that candidates do not have to
+// poll Get to notice a released or expired lock.
+type Watcher interface {
+	// Watch streams changes of the election record made after it was last
+	// read by Get, so that no change between the Get and the Watch is
+	// missed, until ctx is done. The returned channel is closed when ctx is
+	// done or the watch breaks.
+	Watch(ctx context.Context) <-chan WatchEvent
+}
+
+// Revisioner is an optional interface implemented by locks whose backend
+// assigns a monotonically increasing revision to every write of the record.
+type Revisioner interface {
+	// Revision returns the revision of the record as last read or written
+	// by this lock.
+	Revision() int64
+}
+
+// CandidateRegistry is an optional interface implemented by locks that keep
+// track of the live candidates of an election.
+type CandidateRegistry interface {
+	// Register announces the candidate of this lock as live until ctx is
+	// done. The registration expires within ttl if the candidate dies.
+	Register(ctx context.Context, ttl time.Duration) error
+
+	// Candidates returns the live candidates of the election.
+	Candidates(ctx context.Context) ([]Candidate, error)
+
+	// Candidate returns the candidate of this lock.
+	Candidate() Candidate
+}
+
+// Slotter is an optional interface implemented by locks that can be held by
+// several candidates at once, each holding one slot of the lock.
+type Slotter interface {
+	// Slot returns the index of the slot held by this lock, -1 if none.
+	Slot() int
+}
+
+// Advertiser is an optional interface implemented by locks whose holder
+// advertises metadata in the election record.
+type Advertiser interface {
+	// Metadata returns the metadata to advertise while holding the lock.
+	Metadata() map[string]string
+}
+
 // New Manufacture will create a lock of a given type according to the input parameters
 func New(ns string, name string, client *clientv3.Client, rlc ResourceLockConfig) (Interface, error) {
 	leaseLock := &LeaseLock{
@@ -97,3 +214,34 @@ func New(ns string, name string, client *clientv3.Client, rlc ResourceLockConfig
 
 	return leaseLock, nil
 }
+
+// NewForLockType will create a lock of a given type according to the input parameters.
+// client is used by the "leases" lock type, coordinationClient by the "kubeleases" lock type.
+func NewForLockType(lockType string, ns string, name string, client *clientv3.Client, coordinationClient coordinationv1client.CoordinationV1Interface, rlc ResourceLockConfig) (Interface, error) {
+	leaseMeta := metav1.ObjectMeta{
+		Namespace: ns,
+		Name:      name,
+	}
+	switch lockType {
+	case LeasesResourceLock:
+		if client == nil {
+			return nil, fmt.Errorf("etcd client must not be nil for lock-type %s", lockType)
+		}
+		return &LeaseLock{
+			LeaseMeta:  leaseMeta,
+			Client:     client,
+			LockConfig: rlc,
+		}, nil
+	case KubeLeasesResourceLock:
+		if coordinationClient == nil {
+			return nil, fmt.Errorf("coordination client must not be nil for lock-type %s", lockType)
+		}
+		return &KubeLeaseLock{
+			LeaseMeta:  leaseMeta,
+			Client:     coordinationClient,
+			LockConfig: rlc,
+		}, nil
+	default:
+		return nil, fmt.Errorf("Invalid lock-type %s", lockType)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+// KubeLeaseLock stores the election record in a coordination.k8s.io/v1 Lease
+// of the Kubernetes API. Updates are compare-and-swap on the resourceVersion
+// of the Lease.
+type KubeLeaseLock struct {
+	// LeaseMeta should contain a Name and a Namespace of a
+	// LeaseMeta object that the LeaderElector will attempt to lead.
+	LeaseMeta  metav1.ObjectMeta
+	Client     coordinationv1client.LeasesGetter
+	LockConfig ResourceLockConfig
+	lease      *coordinationv1.Lease
+}
+
+// Get returns the election record from a Lease spec
+func (ll *KubeLeaseLock) Get(ctx context.Context) (*LeaderElectionRecord, []byte, error) {
+	lease, err := ll.Client.Leases(ll.LeaseMeta.Namespace).Get(ctx, ll.LeaseMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	record, recordByte, err := leaseToRecord(lease)
+	if err != nil {
+		return nil, nil, err
+	}
+	ll.lease = lease
+	return record, recordByte, nil
+}
+
+// Create attempts to create a Lease. It fails with ErrConflict if the Lease
+// already exists.
+func (ll *KubeLeaseLock) Create(ctx context.Context, ler LeaderElectionRecord) error {
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ll.LeaseMeta.Name,
+			Namespace: ll.LeaseMeta.Namespace,
+		},
+		Spec: LeaderElectionRecordToLeaseSpec(&ler),
+	}
+	if err := setRecordAnnotations(&lease.ObjectMeta, &ler); err != nil {
+		return err
+	}
+	lease, err := ll.Client.Leases(ll.LeaseMeta.Namespace).Create(ctx, lease, metav1.CreateOptions{})
+	if err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return ErrConflict
+		}
+		return err
+	}
+	ll.lease = lease
+	return nil
+}
+
+// Update will update an existing Lease spec. It fails with ErrConflict if
+// the Lease was modified since it was last observed by Get, Create or
+// Update.
+func (ll *KubeLeaseLock) Update(ctx context.Context, ler LeaderElectionRecord) error {
+	if ll.lease == nil {
+		return errors.New("lease not initialized, call get or create first")
+	}
+	lease := ll.lease.DeepCopy()
+	lease.Spec = LeaderElectionRecordToLeaseSpec(&ler)
+	if err := setRecordAnnotations(&lease.ObjectMeta, &ler); err != nil {
+		return err
+	}
+	lease, err := ll.Client.Leases(ll.LeaseMeta.Namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	if err != nil {
+		if apierrors.IsConflict(err) {
+			return ErrConflict
+		}
+		return err
+	}
+	ll.lease = lease
+	return nil
+}
+
+// Watch streams changes of the Lease made after it was last observed, or
+// after Watch was called if it was not observed yet, until ctx is done or the
+// watch breaks.
+func (ll *KubeLeaseLock) Watch(ctx context.Context) <-chan WatchEvent {
+	events := make(chan WatchEvent)
+	opts := metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", ll.LeaseMeta.Name).String(),
+	}
+	if ll.lease != nil {
+		opts.ResourceVersion = ll.lease.ResourceVersion
+	}
+	go func() {
+		defer close(events)
+		w, err := ll.Client.Leases(ll.LeaseMeta.Namespace).Watch(ctx, opts)
+		if err != nil {
+			return
+		}
+		defer w.Stop()
+		for {
+			var event WatchEvent
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.ResultChan():
+				if !ok {
+					return
+				}
+				switch ev.Type {
+				case watch.Added, watch.Modified:
+					lease, ok := ev.Object.(*coordinationv1.Lease)
+					if !ok {
+						return
+					}
+					record, recordByte, err := leaseToRecord(lease)
+					if err != nil {
+						return
+					}
+					event = WatchEvent{Record: record, RawRecord: recordByte}
+				case watch.Deleted:
+				default:
+					// bookmarks and errors
+					continue
+				}
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// RecordEvent in leader election while adding meta-data
+func (ll *KubeLeaseLock) RecordEvent(s string) {
+	if ll.LockConfig.EventRecorder == nil {
+		return
+	}
+	events := fmt.Sprintf("%v %v", ll.LockConfig.Identity, s)
+	subject := &coordinationv1.Lease{ObjectMeta: ll.lease.ObjectMeta}
+	// Populate the type meta, so we don't have to get it from the schema
+	subject.Kind = "Lease"
+	subject.APIVersion = coordinationv1.SchemeGroupVersion.String()
+	ll.LockConfig.EventRecorder.Eventf(subject, corev1.EventTypeNormal, "LeaderElection", events)
+}
+
+// Describe is used to convert details on current resource lock
+// into a string
+func (ll *KubeLeaseLock) Describe() string {
+	return fmt.Sprintf("%v/%v", ll.LeaseMeta.Namespace, ll.LeaseMeta.Name)
+}
+
+// Identity returns the Identity of the lock
+func (ll *KubeLeaseLock) Identity() string {
+	return ll.LockConfig.Identity
+}
+
+// Metadata returns the metadata advertised while holding the lock.
+func (ll *KubeLeaseLock) Metadata() map[string]string {
+	return ll.LockConfig.Metadata
+}
@@ -0,0 +1,191 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeClientset returns a fake clientset whose Leases are versioned like
+// by the API server: writes bump the resourceVersion, and updates of a
+// stale resourceVersion fail with a conflict.
+func newFakeClientset() *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	tracker := client.Tracker()
+	resource := coordinationv1.SchemeGroupVersion.WithResource("leases")
+	var lock sync.Mutex
+	var version int
+	client.PrependReactor("create", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		lease := action.(k8stesting.CreateAction).GetObject().(*coordinationv1.Lease).DeepCopy()
+		version++
+		lease.ResourceVersion = strconv.Itoa(version)
+		if err := tracker.Create(resource, lease, action.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		return true, lease, nil
+	})
+	client.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		lease := action.(k8stesting.UpdateAction).GetObject().(*coordinationv1.Lease).DeepCopy()
+		current, err := tracker.Get(resource, action.GetNamespace(), lease.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		if current.(*coordinationv1.Lease).ResourceVersion != lease.ResourceVersion {
+			return true, nil, apierrors.NewConflict(resource.GroupResource(), lease.Name, errors.New("the object has been modified"))
+		}
+		version++
+		lease.ResourceVersion = strconv.Itoa(version)
+		if err := tracker.Update(resource, lease, action.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		return true, lease, nil
+	})
+	return client
+}
+
+func newTestKubeLeaseLock(client *fake.Clientset, identity string) *KubeLeaseLock {
+	return &KubeLeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: "default", Name: "test"},
+		Client:     client.CoordinationV1(),
+		LockConfig: ResourceLockConfig{Identity: identity},
+	}
+}
+
+func TestKubeLeaseLockGetCreateUpdate(t *testing.T) {
+	client := newFakeClientset()
+	ctx := context.Background()
+	a := newTestKubeLeaseLock(client, "a")
+	if _, _, err := a.Get(ctx); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected NotFound before the lease is created, got %v", err)
+	}
+	now := metav1.NewTime(time.Now().Truncate(time.Second))
+	record := LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10, AcquireTime: now, RenewTime: now}
+	if err := a.Create(ctx, record); err != nil {
+		t.Fatalf("error creating lease: %v", err)
+	}
+
+	b := newTestKubeLeaseLock(client, "b")
+	got, raw, err := b.Get(ctx)
+	if err != nil {
+		t.Fatalf("error reading lease: %v", err)
+	}
+	if got.HolderIdentity != "a" || got.LeaseDurationSeconds != 10 || !got.RenewTime.Equal(&now) || len(raw) == 0 {
+		t.Errorf("expected the created record, got %+v", got)
+	}
+
+	record.RenewTime = metav1.NewTime(now.Add(time.Second))
+	if err := a.Update(ctx, record); err != nil {
+		t.Fatalf("error renewing lease: %v", err)
+	}
+	if got, _, err = b.Get(ctx); err != nil {
+		t.Fatalf("error reading lease: %v", err)
+	}
+	if !got.RenewTime.Equal(&record.RenewTime) {
+		t.Errorf("expected renew time %v, got %v", record.RenewTime, got.RenewTime)
+	}
+}
+
+func TestKubeLeaseLockConflict(t *testing.T) {
+	client := newFakeClientset()
+	ctx := context.Background()
+	a := newTestKubeLeaseLock(client, "a")
+	b := newTestKubeLeaseLock(client, "b")
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "b"}); err == nil {
+		t.Errorf("expected an update before Get to fail")
+	}
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error creating lease: %v", err)
+	}
+	if err := b.Create(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict creating an existing lease, got %v", err)
+	}
+	if _, _, err := b.Get(ctx); err != nil {
+		t.Fatalf("error reading lease: %v", err)
+	}
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error renewing lease: %v", err)
+	}
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict updating a stale resourceVersion, got %v", err)
+	}
+}
+
+func TestKubeLeaseLockWatch(t *testing.T) {
+	client := newFakeClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := newTestKubeLeaseLock(client, "a")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating lease: %v", err)
+	}
+	b := newTestKubeLeaseLock(client, "b")
+	if _, _, err := b.Get(ctx); err != nil {
+		t.Fatalf("error reading lease: %v", err)
+	}
+	events := b.Watch(ctx)
+	// let the watch be established before the lease is released
+	time.Sleep(100 * time.Millisecond)
+	if err := a.Update(ctx, LeaderElectionRecord{LeaseDurationSeconds: 1}); err != nil {
+		t.Fatalf("error releasing lease: %v", err)
+	}
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("watch broke")
+		}
+		if event.Record == nil || event.Record.HolderIdentity != "" || event.Record.LeaseDurationSeconds != 1 {
+			t.Errorf("expected the released record, got %+v", event.Record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch missed the release")
+	}
+	cancel()
+	for range events {
+	}
+}
+
+func TestNewForLockType(t *testing.T) {
+	client := newFakeClientset()
+	lock, err := NewForLockType(KubeLeasesResourceLock, "default", "test", nil, client.CoordinationV1(), ResourceLockConfig{Identity: "a"})
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	if _, ok := lock.(*KubeLeaseLock); !ok {
+		t.Errorf("expected a KubeLeaseLock, got %T", lock)
+	}
+	if _, err := NewForLockType(LeasesResourceLock, "default", "test", nil, client.CoordinationV1(), ResourceLockConfig{}); err == nil {
+		t.Errorf("expected an error creating a leases lock without etcd client")
+	}
+	if _, err := NewForLockType("configmaps", "default", "test", nil, nil, ResourceLockConfig{}); err == nil {
+		t.Errorf("expected an error creating an unknown lock type")
+	}
+}
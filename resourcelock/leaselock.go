@@ -19,14 +19,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/runtime/schema"
+	"math"
 	"path/filepath"
+	"time"
 
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 type LeaseLock struct {
@@ -35,37 +39,49 @@ type LeaseLock struct {
 	LeaseMeta  metav1.ObjectMeta
 	Client     *clientv3.Client
 	LockConfig ResourceLockConfig
-	lease      *coordinationv1.Lease
+	// BindEtcdLease attaches the lease key to an etcd lease with a TTL of
+	// the record's LeaseDurationSeconds, renewed on every Update by the
+	// holder. The record then expires server-side if its holder dies,
+	// instead of relying on the clocks of the other candidates.
+	BindEtcdLease bool
+	lease         *coordinationv1.Lease
+	// modRevision is the etcd revision of the last observed write of the
+	// lease key, used to make Update a compare-and-swap.
+	modRevision int64
+	// leaseID is the etcd lease the key was last bound to by this lock.
+	leaseID clientv3.LeaseID
+	// readRevision is the etcd revision the lease key was last read at by
+	// Get, Watch resumes from it.
+	readRevision int64
 }
 
 // Get returns the election record from a Lease spec
 func (ll *LeaseLock) Get(ctx context.Context) (*LeaderElectionRecord, []byte, error) {
-	lease, err := ll.Client.Get(ctx, filepath.Join(ll.LeaseMeta.Namespace, ll.LeaseMeta.Name))
+	lease, err := ll.Client.Get(ctx, ll.key())
 	if err != nil {
 		return nil, nil, err
 	}
+	ll.readRevision = lease.Header.Revision
 	if len(lease.Kvs) == 0 {
 		return nil, nil, apierrors.NewNotFound(schema.GroupResource{}, "not found")
 	}
-	value := lease.Kvs[0].Value
-
-	var leaseInfo coordinationv1.Lease
-
-	err = json.Unmarshal(value, &leaseInfo)
-	if err != nil {
-		return nil, nil, err
-	}
+	return ll.observe(lease.Kvs[0])
+}
 
-	ll.lease = &leaseInfo
-	record := LeaseSpecToLeaderElectionRecord(&ll.lease.Spec)
-	recordByte, err := json.Marshal(*record)
+// observe decodes the lease key read from etcd and remembers it as the
+// current state of the lease.
+func (ll *LeaseLock) observe(kv *mvccpb.KeyValue) (*LeaderElectionRecord, []byte, error) {
+	leaseInfo, record, recordByte, err := decodeLease(kv.Value)
 	if err != nil {
 		return nil, nil, err
 	}
+	ll.modRevision = kv.ModRevision
+	ll.lease = leaseInfo
 	return record, recordByte, nil
 }
 
-// Create attempts to create a Lease
+// Create attempts to create a Lease. It fails with ErrConflict if the lease
+// key already exists.
 func (ll *LeaseLock) Create(ctx context.Context, ler LeaderElectionRecord) error {
 	var err error
 	leaseInfo := coordinationv1.Lease{
@@ -75,13 +91,16 @@ func (ll *LeaseLock) Create(ctx context.Context, ler LeaderElectionRecord) error
 		},
 		Spec: LeaderElectionRecordToLeaseSpec(&ler),
 	}
+	if err := setRecordAnnotations(&leaseInfo.ObjectMeta, &ler); err != nil {
+		return err
+	}
 	leaseInfoB, err := json.Marshal(leaseInfo)
 	if err != nil {
 		return err
 	}
 
-	_, err = ll.Client.Put(ctx, filepath.Join(ll.LeaseMeta.Namespace, ll.LeaseMeta.Name), string(leaseInfoB))
-	if err != nil {
+	cmp := clientv3.Compare(clientv3.CreateRevision(ll.key()), "=", 0)
+	if err = ll.commit(ctx, cmp, &ler, leaseInfoB); err != nil {
 		return err
 	}
 
@@ -90,26 +109,154 @@ func (ll *LeaseLock) Create(ctx context.Context, ler LeaderElectionRecord) error
 	return nil
 }
 
-// Update will update an existing Lease spec.
+// Update will update an existing Lease spec. It fails with ErrConflict if
+// the lease key was modified since it was last observed by Get, Create or
+// Update.
 func (ll *LeaseLock) Update(ctx context.Context, ler LeaderElectionRecord) error {
 	if ll.lease == nil {
 		return errors.New("lease not initialized, call get or create first")
 	}
 	ll.lease.Spec = LeaderElectionRecordToLeaseSpec(&ler)
+	if err := setRecordAnnotations(&ll.lease.ObjectMeta, &ler); err != nil {
+		return err
+	}
 
 	leaseInfoB, err := json.Marshal(ll.lease)
 	if err != nil {
 		return err
 	}
 
-	_, err = ll.Client.Put(ctx, filepath.Join(ll.LeaseMeta.Namespace, ll.LeaseMeta.Name), string(leaseInfoB))
+	cmp := clientv3.Compare(clientv3.ModRevision(ll.key()), "=", ll.modRevision)
+	return ll.commit(ctx, cmp, &ler, leaseInfoB)
+}
+
+// Watch streams changes of the lease key made after it was last read by Get,
+// or after Watch was called if it was not read yet, until ctx is done or the
+// watch breaks.
+func (ll *LeaseLock) Watch(ctx context.Context) <-chan WatchEvent {
+	events := make(chan WatchEvent)
+	var opts []clientv3.OpOption
+	if ll.readRevision > 0 {
+		opts = append(opts, clientv3.WithRev(ll.readRevision+1))
+	}
+	go func() {
+		defer close(events)
+		for resp := range ll.Client.Watch(clientv3.WithRequireLeader(ctx), ll.key(), opts...) {
+			if resp.Err() != nil {
+				return
+			}
+			for _, ev := range resp.Events {
+				var event WatchEvent
+				if ev.Type == clientv3.EventTypePut {
+					_, record, recordByte, err := decodeLease(ev.Kv.Value)
+					if err != nil {
+						return
+					}
+					event = WatchEvent{Record: record, RawRecord: recordByte}
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// Register announces the candidate of this lock under the candidates prefix
+// of the lease key until ctx is done. The candidate key is bound to an etcd
+// lease of ttl, which is kept alive in the background and registered again
+// if it is lost.
+func (ll *LeaseLock) Register(ctx context.Context, ttl time.Duration) error {
+	candidate := ll.Candidate()
+	candidate.StartTime = metav1.NewTime(time.Now())
+	value, err := json.Marshal(candidate)
+	if err != nil {
+		return err
+	}
+	key := ll.candidateKey(ll.Identity())
+
+	leaseID, keepAlive, err := ll.register(ctx, key, value, ttl)
 	if err != nil {
 		return err
 	}
+	go func() {
+		for {
+			for range keepAlive {
+			}
+			if ctx.Err() != nil {
+				// deregister right away instead of waiting for the ttl
+				revokeCtx, cancel := context.WithTimeout(context.Background(), ttl)
+				ll.Client.Revoke(revokeCtx, leaseID)
+				cancel()
+				return
+			}
 
+			// the lease was lost, register again
+			for {
+				leaseID, keepAlive, err = ll.register(ctx, key, value, ttl)
+				if err == nil {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(ttl / 3):
+				}
+			}
+		}
+	}()
 	return nil
 }
 
+// register puts value under key bound to a new etcd lease of ttl and keeps
+// the lease alive until ctx is done.
+func (ll *LeaseLock) register(ctx context.Context, key string, value []byte, ttl time.Duration) (clientv3.LeaseID, <-chan *clientv3.LeaseKeepAliveResponse, error) {
+	grant, err := ll.Client.Grant(ctx, int64(math.Ceil(ttl.Seconds())))
+	if err != nil {
+		return clientv3.NoLease, nil, err
+	}
+	if _, err = ll.Client.Put(ctx, key, string(value), clientv3.WithLease(grant.ID)); err != nil {
+		ll.Client.Revoke(ctx, grant.ID)
+		return clientv3.NoLease, nil, err
+	}
+	keepAlive, err := ll.Client.KeepAlive(ctx, grant.ID)
+	if err != nil {
+		ll.Client.Revoke(ctx, grant.ID)
+		return clientv3.NoLease, nil, err
+	}
+	return grant.ID, keepAlive, nil
+}
+
+// Candidates returns the candidates registered under the candidates prefix
+// of the lease key.
+func (ll *LeaseLock) Candidates(ctx context.Context) ([]Candidate, error) {
+	resp, err := ll.Client.Get(ctx, ll.candidateKey("")+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]Candidate, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var candidate Candidate
+		if err := json.Unmarshal(kv.Value, &candidate); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// Candidate returns the candidate of this lock
+func (ll *LeaseLock) Candidate() Candidate {
+	return Candidate{
+		Identity:      ll.LockConfig.Identity,
+		Priority:      ll.LockConfig.Priority,
+		BinaryVersion: ll.LockConfig.BinaryVersion,
+	}
+}
+
 // RecordEvent in leader election while adding meta-data
 func (ll *LeaseLock) RecordEvent(s string) {
 	if ll.LockConfig.EventRecorder == nil {
@@ -134,6 +281,155 @@ func (ll *LeaseLock) Identity() string {
 	return ll.LockConfig.Identity
 }
 
+// Metadata returns the metadata advertised while holding the lock.
+func (ll *LeaseLock) Metadata() map[string]string {
+	return ll.LockConfig.Metadata
+}
+
+// Revision returns the etcd revision of the lease key as last read or
+// written by this lock.
+func (ll *LeaseLock) Revision() int64 {
+	return ll.modRevision
+}
+
+// key returns the etcd key the lease is stored under.
+func (ll *LeaseLock) key() string {
+	return filepath.Join(ll.LeaseMeta.Namespace, ll.LeaseMeta.Name)
+}
+
+// candidateKey returns the etcd key the candidate identity is registered
+// under.
+func (ll *LeaseLock) candidateKey(identity string) string {
+	return filepath.Join(ll.key(), CandidatesKeySegment, identity)
+}
+
+// commit writes value to the lease key if cmp holds and returns ErrConflict
+// otherwise. With BindEtcdLease the key is attached to the etcd lease of the
+// record's holder.
+func (ll *LeaseLock) commit(ctx context.Context, cmp clientv3.Cmp, ler *LeaderElectionRecord, value []byte) error {
+	leaseID, granted, err := ll.bindLease(ctx, ler)
+	if err != nil {
+		return err
+	}
+	var opts []clientv3.OpOption
+	switch {
+	case leaseID != clientv3.NoLease:
+		opts = append(opts, clientv3.WithLease(leaseID))
+	case ll.BindEtcdLease && ler.HolderIdentity != "" && ler.HolderIdentity != ll.Identity():
+		// a record held by another candidate stays bound to its lease
+		opts = append(opts, clientv3.WithIgnoreLease())
+	}
+
+	key := ll.key()
+	resp, err := ll.Client.Txn(ctx).
+		If(cmp).
+		Then(clientv3.OpPut(key, string(value), opts...)).
+		Commit()
+	if err == nil && !resp.Succeeded {
+		err = ErrConflict
+	}
+	if err != nil {
+		if granted {
+			ll.Client.Revoke(ctx, leaseID)
+		}
+		return err
+	}
+
+	ll.modRevision = resp.Header.Revision
+	if ll.leaseID != leaseID {
+		// the key is no longer attached to the previous lease
+		if ll.leaseID != clientv3.NoLease {
+			ll.Client.Revoke(ctx, ll.leaseID)
+		}
+		ll.leaseID = leaseID
+	}
+	return nil
+}
+
+// bindLease returns the etcd lease the key should be attached to when
+// writing ler held by this lock's identity. The lease already held by this
+// lock is renewed with KeepAliveOnce, otherwise a new lease is granted and
+// granted is true. Other records are not bound to a lease of this lock.
+func (ll *LeaseLock) bindLease(ctx context.Context, ler *LeaderElectionRecord) (leaseID clientv3.LeaseID, granted bool, err error) {
+	if !ll.BindEtcdLease || ler.HolderIdentity == "" || ler.HolderIdentity != ll.Identity() {
+		return clientv3.NoLease, false, nil
+	}
+	if ll.leaseID != clientv3.NoLease {
+		_, err = ll.Client.KeepAliveOnce(ctx, ll.leaseID)
+		if err == nil {
+			return ll.leaseID, false, nil
+		}
+		if !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			return clientv3.NoLease, false, err
+		}
+	}
+	resp, err := ll.Client.Grant(ctx, int64(ler.LeaseDurationSeconds))
+	if err != nil {
+		return clientv3.NoLease, false, err
+	}
+	return resp.ID, true, nil
+}
+
+// decodeLease decodes a Lease stored under the lease key and returns it
+// along with its election record in parsed and raw form.
+func decodeLease(value []byte) (*coordinationv1.Lease, *LeaderElectionRecord, []byte, error) {
+	var leaseInfo coordinationv1.Lease
+	if err := json.Unmarshal(value, &leaseInfo); err != nil {
+		return nil, nil, nil, err
+	}
+	record, recordByte, err := leaseToRecord(&leaseInfo)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &leaseInfo, record, recordByte, nil
+}
+
+// leaseToRecord returns the election record stored in the spec and the
+// annotations of lease, and its raw form.
+func leaseToRecord(lease *coordinationv1.Lease) (*LeaderElectionRecord, []byte, error) {
+	record := LeaseSpecToLeaderElectionRecord(&lease.Spec)
+	record.PreferredHolder = lease.Annotations[PreferredHolderAnnotationKey]
+	if metadata, ok := lease.Annotations[HolderMetadataAnnotationKey]; ok {
+		if err := json.Unmarshal([]byte(metadata), &record.HolderMetadata); err != nil {
+			return nil, nil, err
+		}
+	}
+	recordByte, err := json.Marshal(*record)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, recordByte, nil
+}
+
+// setRecordAnnotations stores the fields of ler that have no counterpart in
+// the Lease spec as annotations of the Lease.
+func setRecordAnnotations(meta *metav1.ObjectMeta, ler *LeaderElectionRecord) error {
+	setAnnotation(meta, PreferredHolderAnnotationKey, ler.PreferredHolder)
+	if len(ler.HolderMetadata) == 0 {
+		setAnnotation(meta, HolderMetadataAnnotationKey, "")
+		return nil
+	}
+	metadata, err := json.Marshal(ler.HolderMetadata)
+	if err != nil {
+		return err
+	}
+	setAnnotation(meta, HolderMetadataAnnotationKey, string(metadata))
+	return nil
+}
+
+// setAnnotation sets the annotation key of meta to value, or removes it if
+// value is empty.
+func setAnnotation(meta *metav1.ObjectMeta, key, value string) {
+	if value == "" {
+		delete(meta.Annotations, key)
+		return
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[key] = value
+}
+
 func LeaseSpecToLeaderElectionRecord(spec *coordinationv1.LeaseSpec) *LeaderElectionRecord {
 	var r LeaderElectionRecord
 	if spec.HolderIdentity != nil {
@@ -0,0 +1,280 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/khh403/leaderelection/internal/etcdtest"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// etcdServer is shared by the tests of etcd backed locks, nil with -short.
+var etcdServer *etcdtest.Server
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Short() {
+		var err error
+		etcdServer, err = etcdtest.Start()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error starting etcd: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	code := m.Run()
+	if etcdServer != nil {
+		etcdServer.Close()
+	}
+	os.Exit(code)
+}
+
+func newEtcdClient(t *testing.T) *clientv3.Client {
+	t.Helper()
+	if etcdServer == nil {
+		t.Skip("skipping etcd test in short mode")
+	}
+	client := etcdServer.NewClient(t)
+	t.Cleanup(func() {
+		client.Delete(context.Background(), "/test/"+t.Name())
+	})
+	return client
+}
+
+func newTestLeaseLock(client *clientv3.Client, name, identity string) *LeaseLock {
+	return &LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: "/test", Name: name},
+		Client:     client,
+		LockConfig: ResourceLockConfig{Identity: identity},
+	}
+}
+
+func TestLeaseLockWatchResumesFromGet(t *testing.T) {
+	client := newEtcdClient(t)
+	ctx := context.Background()
+	holder := newTestLeaseLock(client, t.Name(), "a")
+	if err := holder.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+
+	follower := newTestLeaseLock(client, t.Name(), "b")
+	if _, _, err := follower.Get(ctx); err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	// the record is released after the follower read it, but before it watches
+	if err := holder.Update(ctx, LeaderElectionRecord{LeaseDurationSeconds: 1}); err != nil {
+		t.Fatalf("error releasing record: %v", err)
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	select {
+	case event, ok := <-follower.Watch(watchCtx):
+		if !ok {
+			t.Fatalf("watch broke")
+		}
+		if event.Record == nil || event.Record.HolderIdentity != "" {
+			t.Errorf("expected the released record, got %+v", event.Record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch missed the release between Get and Watch")
+	}
+}
+
+func TestLeaseLockCompareAndSwap(t *testing.T) {
+	client := newEtcdClient(t)
+	ctx := context.Background()
+	a := newTestLeaseLock(client, t.Name(), "a")
+	b := newTestLeaseLock(client, t.Name(), "b")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	if err := b.Create(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict creating an existing record, got %v", err)
+	}
+	if _, _, err := b.Get(ctx); err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error renewing record: %v", err)
+	}
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict updating a stale record, got %v", err)
+	}
+}
+
+// keyLease returns the etcd lease the lease key of ll is attached to.
+func keyLease(t *testing.T, ll *LeaseLock) clientv3.LeaseID {
+	t.Helper()
+	resp, err := ll.Client.Get(context.Background(), ll.key())
+	if err != nil || len(resp.Kvs) == 0 {
+		t.Fatalf("error reading lease key: %v", err)
+	}
+	return clientv3.LeaseID(resp.Kvs[0].Lease)
+}
+
+// leases returns the etcd leases granted on the server.
+func leases(t *testing.T, client *clientv3.Client) map[clientv3.LeaseID]bool {
+	t.Helper()
+	resp, err := client.Leases(context.Background())
+	if err != nil {
+		t.Fatalf("error listing leases: %v", err)
+	}
+	ids := make(map[clientv3.LeaseID]bool, len(resp.Leases))
+	for _, lease := range resp.Leases {
+		ids[lease.ID] = true
+	}
+	return ids
+}
+
+func newTestBoundLeaseLock(client *clientv3.Client, name, identity string) *LeaseLock {
+	ll := newTestLeaseLock(client, name, identity)
+	ll.BindEtcdLease = true
+	return ll
+}
+
+func TestLeaseLockBindEtcdLeaseRenews(t *testing.T) {
+	client := newEtcdClient(t)
+	ctx := context.Background()
+	a := newTestBoundLeaseLock(client, t.Name(), "a")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	granted := a.leaseID
+	if granted == clientv3.NoLease || keyLease(t, a) != granted {
+		t.Fatalf("expected the key to be bound to a granted lease, got %x and %x", keyLease(t, a), granted)
+	}
+	ttl, err := client.TimeToLive(ctx, granted)
+	if err != nil || ttl.GrantedTTL != 10 {
+		t.Fatalf("expected a lease with a TTL of 10s, got %+v, %v", ttl, err)
+	}
+
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error renewing record: %v", err)
+	}
+	if a.leaseID != granted || keyLease(t, a) != granted {
+		t.Errorf("expected the renewal to keep lease %x, got %x", granted, keyLease(t, a))
+	}
+}
+
+func TestLeaseLockBindEtcdLeaseRevokedOnConflict(t *testing.T) {
+	client := newEtcdClient(t)
+	ctx := context.Background()
+	a := newTestBoundLeaseLock(client, t.Name(), "a")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	b := newTestBoundLeaseLock(client, t.Name(), "b")
+	if _, _, err := b.Get(ctx); err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error renewing record: %v", err)
+	}
+
+	before := leases(t, client)
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "b", LeaseDurationSeconds: 10}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict updating a stale record, got %v", err)
+	}
+	for id := range leases(t, client) {
+		if !before[id] {
+			t.Errorf("lease %x granted for the failed update was not revoked", id)
+		}
+	}
+	if b.leaseID != clientv3.NoLease {
+		t.Errorf("expected b not to hold a lease, got %x", b.leaseID)
+	}
+}
+
+func TestLeaseLockBindEtcdLeaseExpires(t *testing.T) {
+	client := newEtcdClient(t)
+	ctx := context.Background()
+	a := newTestBoundLeaseLock(client, t.Name(), "a")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 1}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+
+	// a stops renewing, the key goes away with its lease
+	b := newTestBoundLeaseLock(client, t.Name(), "b")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, _, err := b.Get(ctx)
+		if apierrors.IsNotFound(err) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("error reading record: %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the key outlived the lease of its holder")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestLeaseLockBindEtcdLeaseIgnoresLeaseOfOtherHolder(t *testing.T) {
+	client := newEtcdClient(t)
+	ctx := context.Background()
+	a := newTestBoundLeaseLock(client, t.Name(), "a")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+
+	// b asks a to yield, writing the record of a
+	b := newTestBoundLeaseLock(client, t.Name(), "b")
+	if _, _, err := b.Get(ctx); err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10, PreferredHolder: "b"}); err != nil {
+		t.Fatalf("error writing the record of a: %v", err)
+	}
+	if lease := keyLease(t, b); lease != a.leaseID {
+		t.Errorf("expected the key to stay bound to lease %x of a, got %x", a.leaseID, lease)
+	}
+	if b.leaseID != clientv3.NoLease {
+		t.Errorf("expected b not to hold a lease, got %x", b.leaseID)
+	}
+}
+
+func TestLeaseLockBindEtcdLeaseRelease(t *testing.T) {
+	client := newEtcdClient(t)
+	ctx := context.Background()
+	a := newTestBoundLeaseLock(client, t.Name(), "a")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	granted := a.leaseID
+
+	if err := a.Update(ctx, LeaderElectionRecord{LeaseDurationSeconds: 1}); err != nil {
+		t.Fatalf("error releasing record: %v", err)
+	}
+	if lease := keyLease(t, a); lease != clientv3.NoLease {
+		t.Errorf("expected the released key to be detached, got lease %x", lease)
+	}
+	if a.leaseID != clientv3.NoLease {
+		t.Errorf("expected a to forget its lease, got %x", a.leaseID)
+	}
+	ttl, err := client.TimeToLive(ctx, granted)
+	if err != nil || ttl.TTL != -1 {
+		t.Errorf("expected lease %x to be revoked, got %+v, %v", granted, ttl, err)
+	}
+}
@@ -0,0 +1,357 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// DefaultRaftApplyTimeout bounds applying a command to the Raft log if the
+// context has no deadline.
+const DefaultRaftApplyTimeout = 10 * time.Second
+
+// raftRecord is a record replicated by RaftFSM.
+type raftRecord struct {
+	// Revision is the index of the Raft log entry that last wrote the record.
+	Revision int64                `json:"revision"`
+	Record   LeaderElectionRecord `json:"record"`
+}
+
+// raftCommand is a write of a record applied to the Raft log.
+type raftCommand struct {
+	Name string `json:"name"`
+	// Create is true if the record must not exist yet.
+	Create bool `json:"create,omitempty"`
+	// Revision is the revision the record must still have, unless Create.
+	Revision int64                `json:"revision,omitempty"`
+	Record   LeaderElectionRecord `json:"record"`
+}
+
+// raftResult is the response of RaftFSM to a raftCommand.
+type raftResult struct {
+	revision int64
+	err      error
+}
+
+// RaftFSM is the Raft state machine of RaftLock, replicating the election
+// records by name. The same RaftFSM can back several RaftLocks of different
+// names.
+type RaftFSM struct {
+	// lock protects records
+	lock    sync.RWMutex
+	records map[string]raftRecord
+}
+
+// NewRaftFSM creates an empty RaftFSM.
+func NewRaftFSM() *RaftFSM {
+	return &RaftFSM{records: map[string]raftRecord{}}
+}
+
+// Apply applies a write of a record committed to the Raft log.
+func (f *RaftFSM) Apply(log *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return raftResult{err: fmt.Errorf("error decoding raft command: %w", err)}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	current, ok := f.records[cmd.Name]
+	if (cmd.Create && ok) || (!cmd.Create && (!ok || current.Revision != cmd.Revision)) {
+		return raftResult{err: ErrConflict}
+	}
+	revision := int64(log.Index)
+	f.records[cmd.Name] = raftRecord{Revision: revision, Record: cmd.Record}
+	return raftResult{revision: revision}
+}
+
+// get returns the record name as applied locally.
+func (f *RaftFSM) get(name string) (raftRecord, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	record, ok := f.records[name]
+	return record, ok
+}
+
+// Snapshot returns a snapshot of the records.
+func (f *RaftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	data, err := json.Marshal(f.records)
+	if err != nil {
+		return nil, err
+	}
+	return raftSnapshot(data), nil
+}
+
+// Restore replaces the records with a snapshot.
+func (f *RaftFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	records := map[string]raftRecord{}
+	if err := json.NewDecoder(snapshot).Decode(&records); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.records = records
+	return nil
+}
+
+type raftSnapshot []byte
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
+
+// RaftForwarder forwards writes from the nodes that are not the Raft leader
+// to the Raft leader.
+type RaftForwarder interface {
+	// Forward passes command to ApplyRaftCommand on the Raft leader at
+	// address, and returns its result. ErrConflict must be returned as is.
+	Forward(ctx context.Context, leader raft.ServerAddress, command []byte) (int64, error)
+}
+
+// ApplyRaftCommand applies a command forwarded by a RaftForwarder to the Raft
+// log, and returns the revision written. It returns the error of ctx once ctx
+// is done, although the command may still be applied then.
+func ApplyRaftCommand(ctx context.Context, r *raft.Raft, command []byte) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	timeout := DefaultRaftApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		// raft takes a timeout of zero for no timeout
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+	}
+	future := r.Apply(command, timeout)
+	applied := make(chan error, 1)
+	go func() { applied <- future.Error() }()
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case err := <-applied:
+		if err != nil {
+			return 0, err
+		}
+	}
+	result, ok := future.Response().(raftResult)
+	if !ok {
+		return 0, fmt.Errorf("unexpected raft response %T", future.Response())
+	}
+	return result.revision, result.err
+}
+
+// raftRPCService is the net/rpc name of the service applying the commands
+// forwarded by RaftRPCForwarder.
+const raftRPCService = "RaftLock"
+
+// raftRPCServer is the receiver of the service served by ServeRaftRPC.
+type raftRPCServer struct {
+	raft *raft.Raft
+}
+
+// Apply applies a forwarded command to the Raft log within
+// DefaultRaftApplyTimeout, see ApplyRaftCommand.
+func (s *raftRPCServer) Apply(command []byte, revision *int64) error {
+	var err error
+	*revision, err = ApplyRaftCommand(context.Background(), s.raft, command)
+	return err
+}
+
+// ServeRaftRPC serves the commands forwarded by RaftRPCForwarder on listener
+// and applies them to r, until listener is closed. Every node that may become
+// the Raft leader must serve them.
+func ServeRaftRPC(listener net.Listener, r *raft.Raft) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName(raftRPCService, &raftRPCServer{raft: r}); err != nil {
+		return err
+	}
+	server.Accept(listener)
+	return nil
+}
+
+// RaftRPCForwarder is a RaftForwarder passing the commands to ServeRaftRPC on
+// the Raft leader over net/rpc. It dials the leader for every write, and the
+// leader applies the command within DefaultRaftApplyTimeout regardless of
+// the deadline of the forwarding context.
+type RaftRPCForwarder struct {
+	// Addr returns the address ServeRaftRPC listens on at the Raft leader
+	// with the Raft address leader.
+	Addr func(leader raft.ServerAddress) string
+}
+
+// Forward implements RaftForwarder.
+func (f *RaftRPCForwarder) Forward(ctx context.Context, leader raft.ServerAddress, command []byte) (int64, error) {
+	if f.Addr == nil {
+		return 0, errors.New("RaftRPCForwarder has no Addr")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", f.Addr(leader))
+	if err != nil {
+		return 0, err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var revision int64
+	call := client.Go(raftRPCService+".Apply", command, &revision, make(chan *rpc.Call, 1))
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-call.Done:
+	}
+	if call.Error != nil {
+		// net/rpc only transfers the message of the error
+		if call.Error.Error() == ErrConflict.Error() {
+			return 0, ErrConflict
+		}
+		return 0, call.Error
+	}
+	return revision, nil
+}
+
+// RaftLock stores the election record in the state machine of a Raft group
+// formed by the candidates themselves, so that no external store is needed.
+// The Raft group is set up by the caller with a RaftFSM, and its members
+// must be the candidates of the election.
+//
+// Get reads the record as applied by the local node. Create and Update are
+// applied to the Raft log, and only succeed if the record was not written
+// since it was last observed. On the nodes that are not the Raft leader,
+// they are passed to the Forwarder, and fail without one. RaftRPCForwarder
+// forwards them to ServeRaftRPC on the Raft leader.
+type RaftLock struct {
+	Raft *raft.Raft
+	FSM  *RaftFSM
+	// Forwarder forwards writes to the Raft leader. Optional.
+	Forwarder RaftForwarder
+	// Name is the name of the record.
+	Name       string
+	LockConfig ResourceLockConfig
+	// revision is the revision of the last observed record, 0 if none.
+	revision int64
+}
+
+// Get returns the election record from the state machine
+func (rl *RaftLock) Get(ctx context.Context) (*LeaderElectionRecord, []byte, error) {
+	record, ok := rl.FSM.get(rl.Name)
+	if !ok {
+		return nil, nil, apierrors.NewNotFound(schema.GroupResource{}, "not found")
+	}
+	recordByte, err := json.Marshal(record.Record)
+	if err != nil {
+		return nil, nil, err
+	}
+	rl.revision = record.Revision
+	return &record.Record, recordByte, nil
+}
+
+// Create attempts to create the record. It fails with ErrConflict if the
+// record already exists.
+func (rl *RaftLock) Create(ctx context.Context, ler LeaderElectionRecord) error {
+	return rl.apply(ctx, raftCommand{Name: rl.Name, Create: true, Record: ler})
+}
+
+// Update will update the existing record. It fails with ErrConflict if the
+// record was modified since it was last observed by Get, Create or Update.
+func (rl *RaftLock) Update(ctx context.Context, ler LeaderElectionRecord) error {
+	if rl.revision == 0 {
+		return errors.New("record not initialized, call get or create first")
+	}
+	return rl.apply(ctx, raftCommand{Name: rl.Name, Revision: rl.revision, Record: ler})
+}
+
+// apply applies cmd on the Raft leader and observes the revision written.
+func (rl *RaftLock) apply(ctx context.Context, cmd raftCommand) error {
+	command, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	var revision int64
+	if rl.Raft.State() == raft.Leader {
+		revision, err = ApplyRaftCommand(ctx, rl.Raft, command)
+	} else {
+		leader, _ := rl.Raft.LeaderWithID()
+		switch {
+		case leader == "":
+			return errors.New("raft group has no leader")
+		case rl.Forwarder == nil:
+			return fmt.Errorf("not the raft leader, the raft leader is %v", leader)
+		}
+		revision, err = rl.Forwarder.Forward(ctx, leader, command)
+	}
+	if err != nil {
+		return err
+	}
+	rl.revision = revision
+	return nil
+}
+
+// RecordEvent in leader election while adding meta-data
+func (rl *RaftLock) RecordEvent(s string) {
+	if rl.LockConfig.EventRecorder == nil {
+		return
+	}
+	events := fmt.Sprintf("%v %v", rl.LockConfig.Identity, s)
+	subject := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: rl.Name}}
+	// Populate the type meta, so we don't have to get it from the schema
+	subject.Kind = "Lease"
+	subject.APIVersion = coordinationv1.SchemeGroupVersion.String()
+	rl.LockConfig.EventRecorder.Eventf(subject, corev1.EventTypeNormal, "LeaderElection", events)
+}
+
+// Describe is used to convert details on current resource lock
+// into a string
+func (rl *RaftLock) Describe() string {
+	return fmt.Sprintf("raft/%v", rl.Name)
+}
+
+// Identity returns the Identity of the lock
+func (rl *RaftLock) Identity() string {
+	return rl.LockConfig.Identity
+}
+
+// Metadata returns the metadata advertised while holding the lock.
+func (rl *RaftLock) Metadata() map[string]string {
+	return rl.LockConfig.Metadata
+}
+
+// Revision returns the index of the Raft log entry that wrote the record as
+// last read or written by this lock.
+func (rl *RaftLock) Revision() int64 {
+	return rl.revision
+}
@@ -0,0 +1,290 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// raftNode is a member of a test Raft group.
+type raftNode struct {
+	raft *raft.Raft
+	fsm  *RaftFSM
+}
+
+// raftCluster is a Raft group of in-memory nodes, forwarding writes to the
+// Raft leader by calling ApplyRaftCommand on it directly.
+type raftCluster struct {
+	nodes map[raft.ServerAddress]*raftNode
+}
+
+func (c *raftCluster) Forward(ctx context.Context, leader raft.ServerAddress, command []byte) (int64, error) {
+	node, ok := c.nodes[leader]
+	if !ok {
+		return 0, fmt.Errorf("unknown raft leader %v", leader)
+	}
+	return ApplyRaftCommand(ctx, node.raft, command)
+}
+
+// newRaftCluster starts a Raft group of n nodes connected by in-memory
+// transports, and waits for it to elect a leader.
+func newRaftCluster(t *testing.T, n int) *raftCluster {
+	t.Helper()
+	c := &raftCluster{nodes: map[raft.ServerAddress]*raftNode{}}
+	transports := map[raft.ServerAddress]*raft.InmemTransport{}
+	var configuration raft.Configuration
+	for i := 0; i < n; i++ {
+		addr, transport := raft.NewInmemTransport(raft.ServerAddress(fmt.Sprintf("node%d", i)))
+		transports[addr] = transport
+		configuration.Servers = append(configuration.Servers, raft.Server{ID: raft.ServerID(addr), Address: addr})
+	}
+	for addr, transport := range transports {
+		for peer, peerTransport := range transports {
+			if peer != addr {
+				transport.Connect(peer, peerTransport)
+			}
+		}
+	}
+	for addr, transport := range transports {
+		config := raft.DefaultConfig()
+		config.LocalID = raft.ServerID(addr)
+		config.HeartbeatTimeout = 100 * time.Millisecond
+		config.ElectionTimeout = 100 * time.Millisecond
+		config.LeaderLeaseTimeout = 100 * time.Millisecond
+		config.CommitTimeout = 5 * time.Millisecond
+		config.LogOutput = io.Discard
+		logs, snapshots := raft.NewInmemStore(), raft.NewInmemSnapshotStore()
+		if err := raft.BootstrapCluster(config, logs, logs, snapshots, transport, configuration); err != nil {
+			t.Fatalf("error bootstrapping %v: %v", addr, err)
+		}
+		fsm := NewRaftFSM()
+		r, err := raft.NewRaft(config, fsm, logs, logs, snapshots, transport)
+		if err != nil {
+			t.Fatalf("error starting %v: %v", addr, err)
+		}
+		t.Cleanup(func() { r.Shutdown().Error() })
+		c.nodes[addr] = &raftNode{raft: r, fsm: fsm}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for c.leader() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("raft group elected no leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c
+}
+
+// leader returns the Raft leader, nil if none.
+func (c *raftCluster) leader() *raftNode {
+	for _, node := range c.nodes {
+		if node.raft.State() == raft.Leader {
+			return node
+		}
+	}
+	return nil
+}
+
+// follower returns a node that is not the Raft leader.
+func (c *raftCluster) follower() *raftNode {
+	for _, node := range c.nodes {
+		if node.raft.State() != raft.Leader {
+			return node
+		}
+	}
+	return nil
+}
+
+func (c *raftCluster) newLock(node *raftNode, identity string, forward bool) *RaftLock {
+	lock := &RaftLock{
+		Raft:       node.raft,
+		FSM:        node.fsm,
+		Name:       "test",
+		LockConfig: ResourceLockConfig{Identity: identity},
+	}
+	if forward {
+		lock.Forwarder = c
+	}
+	return lock
+}
+
+// waitApplied waits until lock reads a record written at revision.
+func waitApplied(t *testing.T, lock *RaftLock, revision int64) *LeaderElectionRecord {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		record, _, err := lock.Get(context.Background())
+		if err == nil && lock.Revision() >= revision {
+			return record
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("revision %v was not applied: %v", revision, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaftLockOnLeader(t *testing.T) {
+	c := newRaftCluster(t, 3)
+	ctx := context.Background()
+	leader := c.leader()
+	a := c.newLock(leader, "a", false)
+	if _, _, err := a.Get(ctx); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected NotFound before the record is created, got %v", err)
+	}
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	b := c.newLock(leader, "b", false)
+	if err := b.Create(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict creating an existing record, got %v", err)
+	}
+	if _, _, err := b.Get(ctx); err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 20}); err != nil {
+		t.Fatalf("error renewing record: %v", err)
+	}
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict updating a stale revision, got %v", err)
+	}
+
+	// the write is replicated to the followers
+	record := waitApplied(t, c.newLock(c.follower(), "c", false), a.Revision())
+	if record.HolderIdentity != "a" || record.LeaseDurationSeconds != 20 {
+		t.Errorf("expected the renewed record on the follower, got %+v", record)
+	}
+}
+
+func TestRaftLockForward(t *testing.T) {
+	c := newRaftCluster(t, 3)
+	ctx := context.Background()
+	follower := c.newLock(c.follower(), "a", true)
+	if err := follower.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record through the leader: %v", err)
+	}
+	revision := follower.Revision()
+	if revision == 0 {
+		t.Fatalf("expected the revision written by the leader to be observed")
+	}
+	if err := follower.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 20}); err != nil {
+		t.Fatalf("error renewing record through the leader: %v", err)
+	}
+	if follower.Revision() <= revision {
+		t.Errorf("expected the renewal to advance the revision from %v, got %v", revision, follower.Revision())
+	}
+
+	other := c.newLock(c.leader(), "b", false)
+	if err := other.Create(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict creating an existing record, got %v", err)
+	}
+	record := waitApplied(t, other, follower.Revision())
+	if record.HolderIdentity != "a" || record.LeaseDurationSeconds != 20 {
+		t.Errorf("expected the record written through the leader, got %+v", record)
+	}
+}
+
+func TestRaftRPCForwarder(t *testing.T) {
+	c := newRaftCluster(t, 3)
+	ctx := context.Background()
+	addrs := map[raft.ServerAddress]string{}
+	for addr, node := range c.nodes {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("error listening: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		addrs[addr] = listener.Addr().String()
+		go ServeRaftRPC(listener, node.raft)
+	}
+	forwarder := &RaftRPCForwarder{Addr: func(leader raft.ServerAddress) string { return addrs[leader] }}
+
+	var followers []*RaftLock
+	for _, node := range c.nodes {
+		if node.raft.State() != raft.Leader {
+			lock := c.newLock(node, fmt.Sprintf("f%d", len(followers)), false)
+			lock.Forwarder = forwarder
+			followers = append(followers, lock)
+		}
+	}
+	a, b := followers[0], followers[1]
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record over net/rpc: %v", err)
+	}
+	if err := b.Create(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict creating an existing record over net/rpc, got %v", err)
+	}
+	revision := a.Revision()
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 20}); err != nil {
+		t.Fatalf("error renewing record over net/rpc: %v", err)
+	}
+	if a.Revision() <= revision {
+		t.Errorf("expected the renewal to advance the revision from %v, got %v", revision, a.Revision())
+	}
+	record := waitApplied(t, b, a.Revision())
+	if record.HolderIdentity != "a" || record.LeaseDurationSeconds != 20 {
+		t.Errorf("expected the record written over net/rpc, got %+v", record)
+	}
+}
+
+func TestRaftLockWithoutForwarder(t *testing.T) {
+	c := newRaftCluster(t, 3)
+	lock := c.newLock(c.follower(), "a", false)
+	err := lock.Create(context.Background(), LeaderElectionRecord{HolderIdentity: "a"})
+	if err == nil || IsConflict(err) {
+		t.Fatalf("expected an error creating a record on a follower without forwarder, got %v", err)
+	}
+}
+
+func TestApplyRaftCommandContext(t *testing.T) {
+	c := newRaftCluster(t, 3)
+	leader := c.leader()
+	command, err := json.Marshal(raftCommand{Name: "test", Create: true, Record: LeaderElectionRecord{HolderIdentity: "a"}})
+	if err != nil {
+		t.Fatalf("error encoding command: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ApplyRaftCommand(cancelled, leader.raft, command); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := ApplyRaftCommand(expired, leader.raft, command); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if err := leader.raft.Barrier(time.Second).Error(); err != nil {
+		t.Fatalf("error waiting for the log to be applied: %v", err)
+	}
+	if _, ok := leader.fsm.get("test"); ok {
+		t.Errorf("command was applied although its context was done")
+	}
+
+	revision, err := ApplyRaftCommand(context.Background(), leader.raft, command)
+	if err != nil || revision == 0 {
+		t.Errorf("error applying command: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// createScript sets KEYS[1] to the record ARGV[1], expiring after ARGV[2]
+// milliseconds, unless it exists. The record is versioned by incrementing
+// the fence counter KEYS[2]. Returns the version, or 0 if KEYS[1] exists.
+var createScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+local version = redis.call("INCR", KEYS[2])
+redis.call("SET", KEYS[1], '{"version":' .. version .. ',"record":' .. ARGV[1] .. '}', "PX", ARGV[2])
+return version
+`)
+
+// updateScript replaces the record at KEYS[1] with ARGV[3], expiring after
+// ARGV[4] milliseconds, if it is still held by ARGV[1] at version ARGV[2].
+// The record is versioned by incrementing the fence counter KEYS[2]. Returns
+// the version, or 0 if the record changed. The holder renews the lease with
+// it, and releases it by writing a record without holder.
+var updateScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if not current then
+	return 0
+end
+local value = cjson.decode(current)
+if value.record.holderIdentity ~= ARGV[1] or value.version ~= tonumber(ARGV[2]) then
+	return 0
+end
+local version = redis.call("INCR", KEYS[2])
+redis.call("SET", KEYS[1], '{"version":' .. version .. ',"record":' .. ARGV[3] .. '}', "PX", ARGV[4])
+return version
+`)
+
+// RedisLock stores the election record in a Redis key, which expires after
+// the lease duration of the record unless it is renewed, so that a dead
+// holder does not keep it. The record is created and replaced by Lua
+// scripts, which check the holder and the version of the record last
+// observed. The versions are drawn from a fence counter at the key
+// "{<Key>}:fence", which does not expire, so that they keep increasing when
+// the record expires and is created again. The counter hashes to the slot of
+// Key in Redis Cluster, unless Key contains braces.
+type RedisLock struct {
+	Client redis.UniversalClient
+	// Key is the key the record is stored at.
+	Key        string
+	LockConfig ResourceLockConfig
+	// observed is the value last read or written by this lock, nil if none.
+	observed *redisValue
+}
+
+// redisValue is the value of the key.
+type redisValue struct {
+	Version int64                `json:"version"`
+	Record  LeaderElectionRecord `json:"record"`
+}
+
+// Get returns the election record from the key
+func (rl *RedisLock) Get(ctx context.Context) (*LeaderElectionRecord, []byte, error) {
+	data, err := rl.Client.Get(ctx, rl.Key).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil, apierrors.NewNotFound(schema.GroupResource{}, "not found")
+		}
+		return nil, nil, err
+	}
+	var value redisValue
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, nil, err
+	}
+	recordByte, err := json.Marshal(value.Record)
+	if err != nil {
+		return nil, nil, err
+	}
+	rl.observed = &value
+	return &value.Record, recordByte, nil
+}
+
+// Create attempts to set the key. It fails with ErrConflict if the key
+// already exists.
+func (rl *RedisLock) Create(ctx context.Context, ler LeaderElectionRecord) error {
+	recordByte, err := json.Marshal(ler)
+	if err != nil {
+		return err
+	}
+	version, err := createScript.Run(ctx, rl.Client, []string{rl.Key, rl.fenceKey()},
+		recordByte, leaseTTL(&ler).Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return ErrConflict
+	}
+	rl.observed = &redisValue{Version: version, Record: ler}
+	return nil
+}
+
+// Update will update the existing record. It fails with ErrConflict if the
+// record was modified or expired since it was last observed by Get, Create
+// or Update.
+func (rl *RedisLock) Update(ctx context.Context, ler LeaderElectionRecord) error {
+	if rl.observed == nil {
+		return errors.New("record not initialized, call get or create first")
+	}
+	recordByte, err := json.Marshal(ler)
+	if err != nil {
+		return err
+	}
+	version, err := updateScript.Run(ctx, rl.Client, []string{rl.Key, rl.fenceKey()},
+		rl.observed.Record.HolderIdentity, rl.observed.Version, recordByte, leaseTTL(&ler).Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return ErrConflict
+	}
+	rl.observed = &redisValue{Version: version, Record: ler}
+	return nil
+}
+
+// fenceKey returns the key of the counter the versions are drawn from.
+func (rl *RedisLock) fenceKey() string {
+	return "{" + rl.Key + "}:fence"
+}
+
+// leaseTTL returns the time the key of ler expires after.
+func leaseTTL(ler *LeaderElectionRecord) time.Duration {
+	ttl := time.Duration(ler.LeaseDurationSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = time.Second
+	}
+	return ttl
+}
+
+// RecordEvent in leader election while adding meta-data
+func (rl *RedisLock) RecordEvent(s string) {
+	if rl.LockConfig.EventRecorder == nil {
+		return
+	}
+	events := fmt.Sprintf("%v %v", rl.LockConfig.Identity, s)
+	subject := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: rl.Key}}
+	// Populate the type meta, so we don't have to get it from the schema
+	subject.Kind = "Lease"
+	subject.APIVersion = coordinationv1.SchemeGroupVersion.String()
+	rl.LockConfig.EventRecorder.Eventf(subject, corev1.EventTypeNormal, "LeaderElection", events)
+}
+
+// Describe is used to convert details on current resource lock
+// into a string
+func (rl *RedisLock) Describe() string {
+	return rl.Key
+}
+
+// Identity returns the Identity of the lock
+func (rl *RedisLock) Identity() string {
+	return rl.LockConfig.Identity
+}
+
+// Metadata returns the metadata advertised while holding the lock.
+func (rl *RedisLock) Metadata() map[string]string {
+	return rl.LockConfig.Metadata
+}
+
+// Revision returns the version of the record as last read or written by
+// this lock. Versions increase across expiries of the record.
+func (rl *RedisLock) Revision() int64 {
+	if rl.observed == nil {
+		return 0
+	}
+	return rl.observed.Version
+}
@@ -0,0 +1,190 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+func newMiniredis(t *testing.T) (*miniredis.Miniredis, redis.UniversalClient) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return mr, client
+}
+
+func newTestRedisLock(client redis.UniversalClient, identity string) *RedisLock {
+	return &RedisLock{
+		Client:     client,
+		Key:        "test",
+		LockConfig: ResourceLockConfig{Identity: identity},
+	}
+}
+
+func TestRedisLockCreateConflict(t *testing.T) {
+	_, client := newMiniredis(t)
+	ctx := context.Background()
+	a := newTestRedisLock(client, "a")
+	if _, _, err := a.Get(ctx); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected NotFound before the record is created, got %v", err)
+	}
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	b := newTestRedisLock(client, "b")
+	if err := b.Create(ctx, LeaderElectionRecord{HolderIdentity: "b", LeaseDurationSeconds: 10}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict creating an existing record, got %v", err)
+	}
+	if record, _, err := b.Get(ctx); err != nil || record.HolderIdentity != "a" {
+		t.Errorf("expected the record of a to be kept, got %+v, %v", record, err)
+	}
+}
+
+func TestRedisLockRenew(t *testing.T) {
+	mr, client := newMiniredis(t)
+	ctx := context.Background()
+	a := newTestRedisLock(client, "a")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	mr.FastForward(5 * time.Second)
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 20}); err != nil {
+		t.Fatalf("error renewing record: %v", err)
+	}
+	if ttl := mr.TTL("test"); ttl != 20*time.Second {
+		t.Errorf("expected the renewal to extend the expiry to 20s, got %v", ttl)
+	}
+
+	b := newTestRedisLock(client, "b")
+	record, raw, err := b.Get(ctx)
+	if err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if record.HolderIdentity != "a" || record.LeaseDurationSeconds != 20 || len(raw) == 0 {
+		t.Errorf("expected the renewed record, got %+v", record)
+	}
+	if a.Revision() != 2 || b.Revision() != 2 {
+		t.Errorf("expected version 2, got %v and %v", a.Revision(), b.Revision())
+	}
+}
+
+func TestRedisLockStaleVersion(t *testing.T) {
+	_, client := newMiniredis(t)
+	ctx := context.Background()
+	a := newTestRedisLock(client, "a")
+	b := newTestRedisLock(client, "b")
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "b"}); err == nil {
+		t.Errorf("expected an update before Get to fail")
+	}
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	if _, _, err := b.Get(ctx); err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error renewing record: %v", err)
+	}
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "b", LeaseDurationSeconds: 10}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict updating a stale version, got %v", err)
+	}
+}
+
+func TestRedisLockOtherHolder(t *testing.T) {
+	mr, client := newMiniredis(t)
+	ctx := context.Background()
+	a := newTestRedisLock(client, "a")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	// the lease of a expires, and b creates a record
+	mr.FastForward(11 * time.Second)
+	b := newTestRedisLock(client, "b")
+	if err := b.Create(ctx, LeaderElectionRecord{HolderIdentity: "b", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record after expiry: %v", err)
+	}
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict renewing the record of another holder, got %v", err)
+	}
+	if record, _, err := b.Get(ctx); err != nil || record.HolderIdentity != "b" {
+		t.Errorf("expected the record of b to be kept, got %+v, %v", record, err)
+	}
+}
+
+func TestRedisLockExpiry(t *testing.T) {
+	mr, client := newMiniredis(t)
+	ctx := context.Background()
+	a := newTestRedisLock(client, "a")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	mr.FastForward(9 * time.Second)
+	if _, _, err := a.Get(ctx); err != nil {
+		t.Fatalf("expected the record to live for its lease duration, got %v", err)
+	}
+	mr.FastForward(2 * time.Second)
+	if _, _, err := a.Get(ctx); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected NotFound once the lease expired, got %v", err)
+	}
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict renewing an expired record, got %v", err)
+	}
+}
+
+func TestRedisLockRevisionIncreasesAcrossExpiry(t *testing.T) {
+	mr, client := newMiniredis(t)
+	ctx := context.Background()
+	a := newTestRedisLock(client, "a")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+			t.Fatalf("error renewing record: %v", err)
+		}
+	}
+	last := a.Revision()
+
+	// a releases the lease, which expires, then b and c take over after
+	// another expiry
+	if err := a.Update(ctx, LeaderElectionRecord{LeaseDurationSeconds: 1}); err != nil {
+		t.Fatalf("error releasing record: %v", err)
+	}
+	if a.Revision() <= last {
+		t.Fatalf("release did not increase the revision from %v, got %v", last, a.Revision())
+	}
+	last = a.Revision()
+	for _, identity := range []string{"b", "c"} {
+		mr.FastForward(11 * time.Second)
+		lock := newTestRedisLock(client, identity)
+		if err := lock.Create(ctx, LeaderElectionRecord{HolderIdentity: identity, LeaseDurationSeconds: 10}); err != nil {
+			t.Fatalf("error creating record after expiry: %v", err)
+		}
+		if lock.Revision() <= last {
+			t.Errorf("revision of %v went down from %v to %v after the record expired", identity, last, lock.Revision())
+		}
+		if _, _, err := lock.Get(ctx); err != nil || lock.Revision() <= last {
+			t.Errorf("expected revision above %v to be read, got %v, %v", last, lock.Revision(), err)
+		}
+		last = lock.Revision()
+	}
+}
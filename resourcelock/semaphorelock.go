@@ -0,0 +1,192 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// SemaphoreLock lets up to MaxHolders candidates hold one election at the
+// same time. Every holder owns one of the slots of the lock, each a LeaseLock
+// bound to an etcd lease, so that a LeaderElector acquires, renews and
+// releases a slot the way it does a single lease. A candidate sticks to the
+// slot it holds, and otherwise competes for the first free slot.
+type SemaphoreLock struct {
+	// SlotsMeta contains the Name and the Namespace of the election, the
+	// slots are stored under <namespace>/<name>/slots/<index>.
+	SlotsMeta  metav1.ObjectMeta
+	Client     *clientv3.Client
+	LockConfig ResourceLockConfig
+
+	slots []*LeaseLock
+	// current is the index of the slot the last Get returned
+	current int
+	// held is the index of the slot held by this lock, -1 if none
+	held int
+}
+
+var _ Interface = &SemaphoreLock{}
+var _ Slotter = &SemaphoreLock{}
+
+// NewSemaphoreLock creates a SemaphoreLock with maxHolders slots.
+func NewSemaphoreLock(ns string, name string, maxHolders int, client *clientv3.Client, rlc ResourceLockConfig) (*SemaphoreLock, error) {
+	if maxHolders < 1 {
+		return nil, fmt.Errorf("maxHolders must be greater than zero")
+	}
+	sl := &SemaphoreLock{
+		SlotsMeta: metav1.ObjectMeta{
+			Namespace: ns,
+			Name:      name,
+		},
+		Client:     client,
+		LockConfig: rlc,
+		held:       -1,
+	}
+	for i := 0; i < maxHolders; i++ {
+		sl.slots = append(sl.slots, &LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Namespace: sl.slotsPrefix(),
+				Name:      strconv.Itoa(i),
+			},
+			Client:        client,
+			LockConfig:    rlc,
+			BindEtcdLease: true,
+		})
+	}
+	return sl, nil
+}
+
+// Get returns the election record of the slot held by this lock. If it does
+// not hold one, it returns the record of the first free slot, or of the first
+// slot if all are taken.
+func (sl *SemaphoreLock) Get(ctx context.Context) (*LeaderElectionRecord, []byte, error) {
+	resp, err := sl.Client.Get(ctx, sl.slotsPrefix()+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, nil, err
+	}
+	slots := make(map[string]*LeaseLock, len(sl.slots))
+	for _, slot := range sl.slots {
+		slots[slot.key()] = slot
+	}
+	records := make([]*LeaderElectionRecord, len(sl.slots))
+	raws := make([][]byte, len(sl.slots))
+	for _, kv := range resp.Kvs {
+		slot, ok := slots[string(kv.Key)]
+		if !ok {
+			continue
+		}
+		index, _ := strconv.Atoi(slot.LeaseMeta.Name)
+		if records[index], raws[index], err = slot.observe(kv); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if sl.held >= 0 {
+		if records[sl.held] == nil || records[sl.held].HolderIdentity == sl.Identity() {
+			return sl.use(sl.held, records, raws)
+		}
+		// the slot was taken over
+		sl.held = -1
+	}
+	for i, record := range records {
+		if record == nil || len(record.HolderIdentity) == 0 {
+			return sl.use(i, records, raws)
+		}
+	}
+	return sl.use(0, records, raws)
+}
+
+// use makes slot i the current slot and returns its record.
+func (sl *SemaphoreLock) use(i int, records []*LeaderElectionRecord, raws [][]byte) (*LeaderElectionRecord, []byte, error) {
+	sl.current = i
+	if records[i] == nil {
+		return nil, nil, apierrors.NewNotFound(schema.GroupResource{}, "not found")
+	}
+	return records[i], raws[i], nil
+}
+
+// Create attempts to create the current slot
+func (sl *SemaphoreLock) Create(ctx context.Context, ler LeaderElectionRecord) error {
+	if err := sl.slots[sl.current].Create(ctx, ler); err != nil {
+		return err
+	}
+	sl.hold(&ler)
+	return nil
+}
+
+// Update will update the current slot
+func (sl *SemaphoreLock) Update(ctx context.Context, ler LeaderElectionRecord) error {
+	if err := sl.slots[sl.current].Update(ctx, ler); err != nil {
+		return err
+	}
+	sl.hold(&ler)
+	return nil
+}
+
+// hold records whether the current slot is held by this lock after writing
+// ler to it.
+func (sl *SemaphoreLock) hold(ler *LeaderElectionRecord) {
+	switch {
+	case ler.HolderIdentity == sl.Identity():
+		sl.held = sl.current
+	case sl.held == sl.current:
+		sl.held = -1
+	}
+}
+
+// RecordEvent in leader election while adding meta-data
+func (sl *SemaphoreLock) RecordEvent(s string) {
+	sl.slots[sl.current].RecordEvent(s)
+}
+
+// Describe is used to convert details on current resource lock
+// into a string
+func (sl *SemaphoreLock) Describe() string {
+	return fmt.Sprintf("%v/%v[%v]", sl.SlotsMeta.Namespace, sl.SlotsMeta.Name, sl.current)
+}
+
+// Identity returns the Identity of the lock
+func (sl *SemaphoreLock) Identity() string {
+	return sl.LockConfig.Identity
+}
+
+// Metadata returns the metadata advertised while holding a slot.
+func (sl *SemaphoreLock) Metadata() map[string]string {
+	return sl.LockConfig.Metadata
+}
+
+// Revision returns the etcd revision of the current slot as last read or
+// written by this lock.
+func (sl *SemaphoreLock) Revision() int64 {
+	return sl.slots[sl.current].Revision()
+}
+
+// Slot returns the index of the slot held by this lock, -1 if none.
+func (sl *SemaphoreLock) Slot() int {
+	return sl.held
+}
+
+// slotsPrefix returns the etcd key prefix of the slots.
+func (sl *SemaphoreLock) slotsPrefix() string {
+	return filepath.Join(sl.SlotsMeta.Namespace, sl.SlotsMeta.Name, "slots")
+}
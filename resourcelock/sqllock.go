@@ -0,0 +1,261 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// DefaultSQLTable is the table SQLLock stores the records in by default.
+const DefaultSQLTable = "leader_election"
+
+// Dialect adapts the statements of SQLLock to a database.
+type Dialect interface {
+	// Placeholder returns the placeholder of the n-th parameter, counted
+	// from 1.
+	Placeholder(n int) string
+	// CreateTable returns the statement creating table with the columns
+	// name, version and record, unless it exists.
+	CreateTable(table string) string
+	// InsertIfAbsent returns the statement inserting name, version and
+	// record into table, which inserts nothing if name exists.
+	InsertIfAbsent(table string) string
+}
+
+var (
+	// SQLiteDialect is the Dialect of SQLite.
+	SQLiteDialect Dialect = sqliteDialect{}
+	// PostgresDialect is the Dialect of PostgreSQL.
+	PostgresDialect Dialect = postgresDialect{}
+	// MySQLDialect is the Dialect of MySQL.
+	MySQLDialect Dialect = mysqlDialect{}
+)
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Placeholder(int) string {
+	return "?"
+}
+
+func (sqliteDialect) CreateTable(table string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name TEXT PRIMARY KEY, version INTEGER NOT NULL, record TEXT NOT NULL)", table)
+}
+
+func (sqliteDialect) InsertIfAbsent(table string) string {
+	return fmt.Sprintf("INSERT OR IGNORE INTO %s (name, version, record) VALUES (?, ?, ?)", table)
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func (postgresDialect) CreateTable(table string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name VARCHAR(255) PRIMARY KEY, version BIGINT NOT NULL, record TEXT NOT NULL)", table)
+}
+
+func (postgresDialect) InsertIfAbsent(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (name, version, record) VALUES ($1, $2, $3) ON CONFLICT (name) DO NOTHING", table)
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Placeholder(int) string {
+	return "?"
+}
+
+func (mysqlDialect) CreateTable(table string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name VARCHAR(255) PRIMARY KEY, version BIGINT NOT NULL, record TEXT NOT NULL)", table)
+}
+
+func (mysqlDialect) InsertIfAbsent(table string) string {
+	return fmt.Sprintf("INSERT IGNORE INTO %s (name, version, record) VALUES (?, ?, ?)", table)
+}
+
+// SQLLock stores the election record in a row of a database table, which is
+// created if it does not exist. Every write increments the version column of
+// the row, and Update only writes the row if its version was not changed
+// since it was last observed.
+type SQLLock struct {
+	DB *sql.DB
+	// Dialect adapts the statements to the database, SQLiteDialect if nil.
+	Dialect Dialect
+	// Table is the table the record is stored in, DefaultSQLTable if empty.
+	// It is not quoted and must be a valid identifier.
+	Table string
+	// Name is the name of the election, the primary key of the row.
+	Name       string
+	LockConfig ResourceLockConfig
+	// version is the version of the last observed row, 0 if none.
+	version int64
+
+	// schemaLock protects schemaCreated
+	schemaLock    sync.Mutex
+	schemaCreated bool
+}
+
+// Get returns the election record from the row
+func (sl *SQLLock) Get(ctx context.Context) (*LeaderElectionRecord, []byte, error) {
+	if err := sl.createSchema(ctx); err != nil {
+		return nil, nil, err
+	}
+	query := fmt.Sprintf("SELECT version, record FROM %s WHERE name = %s", sl.table(), sl.dialect().Placeholder(1))
+	var version int64
+	var recordByte []byte
+	if err := sl.DB.QueryRowContext(ctx, query, sl.Name).Scan(&version, &recordByte); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, apierrors.NewNotFound(schema.GroupResource{}, "not found")
+		}
+		return nil, nil, err
+	}
+	var record LeaderElectionRecord
+	if err := json.Unmarshal(recordByte, &record); err != nil {
+		return nil, nil, err
+	}
+	sl.version = version
+	return &record, recordByte, nil
+}
+
+// Create attempts to insert the row. It fails with ErrConflict if the row
+// already exists.
+func (sl *SQLLock) Create(ctx context.Context, ler LeaderElectionRecord) error {
+	if err := sl.createSchema(ctx); err != nil {
+		return err
+	}
+	recordByte, err := json.Marshal(ler)
+	if err != nil {
+		return err
+	}
+	result, err := sl.DB.ExecContext(ctx, sl.dialect().InsertIfAbsent(sl.table()), sl.Name, 1, string(recordByte))
+	if err := sl.checkWritten(result, err); err != nil {
+		return err
+	}
+	sl.version = 1
+	return nil
+}
+
+// Update will update the existing row. It fails with ErrConflict if the row
+// was modified since it was last observed by Get, Create or Update.
+func (sl *SQLLock) Update(ctx context.Context, ler LeaderElectionRecord) error {
+	if sl.version == 0 {
+		return errors.New("record not initialized, call get or create first")
+	}
+	recordByte, err := json.Marshal(ler)
+	if err != nil {
+		return err
+	}
+	d := sl.dialect()
+	query := fmt.Sprintf("UPDATE %s SET version = %s, record = %s WHERE name = %s AND version = %s",
+		sl.table(), d.Placeholder(1), d.Placeholder(2), d.Placeholder(3), d.Placeholder(4))
+	result, err := sl.DB.ExecContext(ctx, query, sl.version+1, string(recordByte), sl.Name, sl.version)
+	if err := sl.checkWritten(result, err); err != nil {
+		return err
+	}
+	sl.version++
+	return nil
+}
+
+// checkWritten returns ErrConflict if the statement with result did not
+// write the row.
+func (sl *SQLLock) checkWritten(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// createSchema creates the table unless it was created before.
+func (sl *SQLLock) createSchema(ctx context.Context) error {
+	sl.schemaLock.Lock()
+	defer sl.schemaLock.Unlock()
+	if sl.schemaCreated {
+		return nil
+	}
+	if _, err := sl.DB.ExecContext(ctx, sl.dialect().CreateTable(sl.table())); err != nil {
+		return fmt.Errorf("error creating table %v: %w", sl.table(), err)
+	}
+	sl.schemaCreated = true
+	return nil
+}
+
+// dialect returns the Dialect of the database.
+func (sl *SQLLock) dialect() Dialect {
+	if sl.Dialect == nil {
+		return SQLiteDialect
+	}
+	return sl.Dialect
+}
+
+// table returns the table the record is stored in.
+func (sl *SQLLock) table() string {
+	if sl.Table == "" {
+		return DefaultSQLTable
+	}
+	return sl.Table
+}
+
+// RecordEvent in leader election while adding meta-data
+func (sl *SQLLock) RecordEvent(s string) {
+	if sl.LockConfig.EventRecorder == nil {
+		return
+	}
+	events := fmt.Sprintf("%v %v", sl.LockConfig.Identity, s)
+	subject := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: sl.Name}}
+	// Populate the type meta, so we don't have to get it from the schema
+	subject.Kind = "Lease"
+	subject.APIVersion = coordinationv1.SchemeGroupVersion.String()
+	sl.LockConfig.EventRecorder.Eventf(subject, corev1.EventTypeNormal, "LeaderElection", events)
+}
+
+// Describe is used to convert details on current resource lock
+// into a string
+func (sl *SQLLock) Describe() string {
+	return fmt.Sprintf("%v/%v", sl.table(), sl.Name)
+}
+
+// Identity returns the Identity of the lock
+func (sl *SQLLock) Identity() string {
+	return sl.LockConfig.Identity
+}
+
+// Metadata returns the metadata advertised while holding the lock.
+func (sl *SQLLock) Metadata() map[string]string {
+	return sl.LockConfig.Metadata
+}
+
+// Revision returns the version of the row as last read or written by this
+// lock.
+func (sl *SQLLock) Revision() int64 {
+	return sl.version
+}
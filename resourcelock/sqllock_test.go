@@ -0,0 +1,141 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package resourcelock
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	_ "modernc.org/sqlite"
+)
+
+func newSQLiteDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestSQLLock(db *sql.DB, identity string) *SQLLock {
+	return &SQLLock{
+		DB:         db,
+		Dialect:    SQLiteDialect,
+		Name:       "test",
+		LockConfig: ResourceLockConfig{Identity: identity},
+	}
+}
+
+func TestSQLLockCreatesSchema(t *testing.T) {
+	db := newSQLiteDB(t)
+	ctx := context.Background()
+	for _, table := range []string{"", "elections"} {
+		lock := newTestSQLLock(db, "a")
+		lock.Table = table
+		if _, _, err := lock.Get(ctx); !apierrors.IsNotFound(err) {
+			t.Fatalf("expected NotFound in a new table, got %v", err)
+		}
+		var name string
+		err := db.QueryRowContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", lock.table()).Scan(&name)
+		if err != nil {
+			t.Errorf("table %v was not created: %v", lock.table(), err)
+		}
+	}
+}
+
+func TestSQLLockCreateGetUpdate(t *testing.T) {
+	db := newSQLiteDB(t)
+	ctx := context.Background()
+	a := newTestSQLLock(db, "a")
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaseDurationSeconds: 10, LeaderTransitions: 1}); err != nil {
+		t.Fatalf("error renewing record: %v", err)
+	}
+
+	b := newTestSQLLock(db, "b")
+	record, raw, err := b.Get(ctx)
+	if err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if record.HolderIdentity != "a" || record.LeaderTransitions != 1 || len(raw) == 0 {
+		t.Errorf("expected the renewed record, got %+v", record)
+	}
+	if a.Revision() != 2 || b.Revision() != 2 {
+		t.Errorf("expected version 2, got %v and %v", a.Revision(), b.Revision())
+	}
+}
+
+func TestSQLLockDefaultDialect(t *testing.T) {
+	db := newSQLiteDB(t)
+	ctx := context.Background()
+	lock := newTestSQLLock(db, "a")
+	lock.Dialect = nil
+	if err := lock.Create(ctx, LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error creating record with the default dialect: %v", err)
+	}
+	if err := lock.Update(ctx, LeaderElectionRecord{HolderIdentity: "a", LeaderTransitions: 1}); err != nil {
+		t.Fatalf("error renewing record with the default dialect: %v", err)
+	}
+	if record, _, err := lock.Get(ctx); err != nil || record.LeaderTransitions != 1 {
+		t.Errorf("expected the renewed record, got %+v, %v", record, err)
+	}
+}
+
+func TestSQLLockCreateConflict(t *testing.T) {
+	db := newSQLiteDB(t)
+	ctx := context.Background()
+	if err := newTestSQLLock(db, "a").Create(ctx, LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	b := newTestSQLLock(db, "b")
+	if err := b.Create(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict creating an existing record, got %v", err)
+	}
+	if record, _, err := b.Get(ctx); err != nil || record.HolderIdentity != "a" {
+		t.Errorf("expected the record of a to be kept, got %+v, %v", record, err)
+	}
+}
+
+func TestSQLLockStaleUpdate(t *testing.T) {
+	db := newSQLiteDB(t)
+	ctx := context.Background()
+	a := newTestSQLLock(db, "a")
+	b := newTestSQLLock(db, "b")
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "b"}); err == nil {
+		t.Errorf("expected an update before Get to fail")
+	}
+	if err := a.Create(ctx, LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error creating record: %v", err)
+	}
+	if _, _, err := b.Get(ctx); err != nil {
+		t.Fatalf("error reading record: %v", err)
+	}
+	if err := a.Update(ctx, LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("error renewing record: %v", err)
+	}
+	if err := b.Update(ctx, LeaderElectionRecord{HolderIdentity: "b"}); !IsConflict(err) {
+		t.Fatalf("expected ErrConflict updating a stale version, got %v", err)
+	}
+	if record, _, err := b.Get(ctx); err != nil || record.HolderIdentity != "a" {
+		t.Errorf("expected the record of a to be kept, got %+v, %v", record, err)
+	}
+}
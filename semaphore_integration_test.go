@@ -0,0 +1,161 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/khh403/leaderelection"
+	rl "github.com/khh403/leaderelection/resourcelock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// slotHolders tracks the slot each candidate of a test leads with.
+type slotHolders struct {
+	mu    sync.Mutex
+	slots map[string]int
+}
+
+func (h *slotHolders) get() map[string]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	slots := make(map[string]int, len(h.slots))
+	for id, slot := range h.slots {
+		slots[id] = slot
+	}
+	return slots
+}
+
+// startSemaphoreCandidate starts a candidate for one of maxHolders slots of
+// the semaphore named after the test.
+func startSemaphoreCandidate(t *testing.T, client *clientv3.Client, holders *slotHolders, id string, maxHolders int) *candidate {
+	t.Helper()
+	lock, err := rl.NewSemaphoreLock("/integration", t.Name(), maxHolders, client, rl.ResourceLockConfig{Identity: id})
+	if err != nil {
+		t.Fatalf("error creating semaphore lock: %v", err)
+	}
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   testLeaseDuration,
+		RenewDeadline:   testRenewDeadline,
+		RetryPeriod:     testRetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				slot, ok := leaderelection.SlotFromContext(ctx)
+				if !ok {
+					t.Errorf("%v leads without a slot", id)
+				}
+				holders.mu.Lock()
+				holders.slots[id] = slot
+				holders.mu.Unlock()
+				<-ctx.Done()
+				holders.mu.Lock()
+				delete(holders.slots, id)
+				holders.mu.Unlock()
+			},
+			OnStoppedLeading: func() {},
+		},
+		Name: id,
+	})
+	if err != nil {
+		t.Fatalf("error creating elector %v: %v", id, err)
+	}
+	c := &candidate{id: id, le: le, result: make(chan error, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go func() { c.result <- le.RunE(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-c.result
+	})
+	return c
+}
+
+// waitForHolders waits until n candidates lead and returns their slots.
+func waitForHolders(t *testing.T, holders *slotHolders, n int) map[string]int {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if slots := holders.get(); len(slots) == n {
+			return slots
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %v candidates to lead, got %v", n, holders.get())
+	return nil
+}
+
+func TestIntegrationSemaphore(t *testing.T) {
+	const maxHolders = 2
+	client := newClient(t)
+	t.Cleanup(func() {
+		client.Delete(context.Background(), "/integration/"+t.Name(), clientv3.WithPrefix())
+	})
+	holders := &slotHolders{slots: map[string]int{}}
+	candidates := map[string]*candidate{}
+	for _, id := range []string{"a", "b", "c"} {
+		candidates[id] = startSemaphoreCandidate(t, client, holders, id, maxHolders)
+	}
+
+	slots := waitForHolders(t, holders, maxHolders)
+	// the waiting candidate must not get in on a taken slot
+	time.Sleep(2 * testRetryPeriod)
+	if current := holders.get(); len(current) != maxHolders {
+		t.Fatalf("expected %v candidates to lead, got %v", maxHolders, current)
+	}
+	taken := map[int]string{}
+	for id, slot := range slots {
+		if other, ok := taken[slot]; ok {
+			t.Fatalf("%v and %v both lead with slot %v", id, other, slot)
+		}
+		if slot < 0 || slot >= maxHolders {
+			t.Fatalf("%v leads with slot %v out of range", id, slot)
+		}
+		taken[slot] = id
+	}
+
+	// the candidate holding slot 0 leaves, the waiting one takes its slot
+	leaving := taken[0]
+	waiting := ""
+	for id := range candidates {
+		if _, ok := slots[id]; !ok {
+			waiting = id
+		}
+	}
+	if err := candidates[leaving].stop(t); err == nil {
+		t.Fatalf("expected %v to stop with an error", leaving)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		current := holders.get()
+		if slot, ok := current[waiting]; ok {
+			if slot != 0 {
+				t.Errorf("expected %v to take the freed slot 0, got %v", waiting, slot)
+			}
+			if len(current) != maxHolders {
+				t.Errorf("expected %v candidates to lead, got %v", maxHolders, current)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v did not take the freed slot, leading: %v", waiting, current)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,340 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// ShardedElectionConfig configures a ShardedElector.
+type ShardedElectionConfig struct {
+	// Client is the etcd client shared by all shards.
+	Client *clientv3.Client
+	// Namespace and Name identify the election. Shard i is stored under
+	// <namespace>/<name>/shards/<i>, and the candidates register under
+	// <namespace>/<name>/candidates/.
+	Namespace string
+	Name      string
+	// Shards is the number of shards distributed across the candidates.
+	Shards int
+	// LockConfig identifies this candidate.
+	LockConfig rl.ResourceLockConfig
+
+	// LeaseDuration, RenewDeadline and RetryPeriod apply to every shard, see
+	// LeaderElectionConfig.
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+
+	// Callbacks are called for every shard this candidate starts or stops
+	// leading.
+	Callbacks ShardCallbacks
+
+	// ReleaseOnCancel releases the leases of all shards when the run context
+	// is cancelled, see LeaderElectionConfig.
+	ReleaseOnCancel bool
+}
+
+// ShardCallbacks are callbacks that are triggered when a ShardedElector
+// starts or stops leading a shard.
+type ShardCallbacks struct {
+	// OnStartedLeading is called when the candidate starts leading shard.
+	// It must return once ctx is cancelled.
+	OnStartedLeading func(ctx context.Context, shard int)
+	// OnStoppedLeading is called when the candidate stopped leading shard,
+	// after OnStartedLeading returned.
+	OnStoppedLeading func(shard int)
+}
+
+// ShardedElector distributes the leadership of a number of shards across the
+// live candidates. Shard i is assigned to the i-th candidate modulo the
+// number of candidates, ordered by identity, and is handed over when
+// candidates join or leave. A single loop acquires and renews the leases of
+// all shards over one etcd client.
+type ShardedElector struct {
+	config   ShardedElectionConfig
+	registry *rl.LeaseLock
+	shards   []*shard
+
+	// lock protects the leading state of the shards
+	lock sync.Mutex
+}
+
+// shard is a shard of a ShardedElector. Its LeaderElector is only used to
+// acquire, renew and release the lease, not run.
+type shard struct {
+	index   int
+	elector *LeaderElector
+
+	// leading is true from acquiring the lease until the shard stopped
+	leading bool
+	// stopping is true while the shard is being stopped
+	stopping bool
+	// cancel cancels the context passed to OnStartedLeading
+	cancel context.CancelFunc
+	// done is closed once OnStartedLeading returned
+	done chan struct{}
+	// renewed is the time the lease was last acquired or renewed
+	renewed time.Time
+}
+
+// NewShardedElector creates a ShardedElector from a ShardedElectionConfig.
+func NewShardedElector(sec ShardedElectionConfig) (*ShardedElector, error) {
+	if sec.Client == nil {
+		return nil, fmt.Errorf("Client must not be nil")
+	}
+	if sec.Shards < 1 {
+		return nil, fmt.Errorf("shards must be greater than zero")
+	}
+	if sec.Callbacks.OnStartedLeading == nil {
+		return nil, fmt.Errorf("OnStartedLeading callback must not be nil")
+	}
+	if sec.Callbacks.OnStoppedLeading == nil {
+		return nil, fmt.Errorf("OnStoppedLeading callback must not be nil")
+	}
+
+	se := &ShardedElector{
+		config: sec,
+		registry: &rl.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Namespace: sec.Namespace,
+				Name:      sec.Name,
+			},
+			Client:     sec.Client,
+			LockConfig: sec.LockConfig,
+		},
+	}
+	for i := 0; i < sec.Shards; i++ {
+		le, err := NewLeaderElector(LeaderElectionConfig{
+			Lock: &rl.LeaseLock{
+				LeaseMeta: metav1.ObjectMeta{
+					Namespace: filepath.Join(sec.Namespace, sec.Name, "shards"),
+					Name:      strconv.Itoa(i),
+				},
+				Client:        sec.Client,
+				LockConfig:    sec.LockConfig,
+				BindEtcdLease: true,
+			},
+			LeaseDuration: sec.LeaseDuration,
+			RenewDeadline: sec.RenewDeadline,
+			RetryPeriod:   sec.RetryPeriod,
+			// the shard callbacks are invoked by the ShardedElector
+			Callbacks: LeaderCallbacks{
+				OnStartedLeading: func(context.Context) {},
+				OnStoppedLeading: func() {},
+			},
+			Name: fmt.Sprintf("%v/%v", sec.Name, i),
+		})
+		if err != nil {
+			return nil, err
+		}
+		se.shards = append(se.shards, &shard{index: i, elector: le})
+	}
+	return se, nil
+}
+
+// Run registers the candidate and balances the shards until ctx is done.
+// Before returning, it stops leading all shards.
+func (se *ShardedElector) Run(ctx context.Context) {
+	defer runtime.HandleCrash()
+
+	go wait.PollImmediateUntil(se.config.RetryPeriod, func() (bool, error) {
+		if err := se.registry.Register(ctx, se.config.LeaseDuration); err != nil {
+			klog.Errorf("error registering candidate for %v: %v", se.registry.Describe(), err)
+			return false, nil
+		}
+		return true, nil
+	}, ctx.Done())
+
+	wait.JitterUntil(func() {
+		se.reconcile(ctx)
+	}, se.config.RetryPeriod, JitterFactor, true, ctx.Done())
+
+	var wg sync.WaitGroup
+	for _, s := range se.shards {
+		if done := se.stop(s, se.config.ReleaseOnCancel); done != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-done
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// LeadingShards returns the shards this candidate currently leads.
+func (se *ShardedElector) LeadingShards() []int {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	var shards []int
+	for _, s := range se.shards {
+		if s.leading && !s.stopping {
+			shards = append(shards, s.index)
+		}
+	}
+	return shards
+}
+
+// reconcile renews the shards led by this candidate, hands over those
+// assigned to other candidates and acquires those assigned to it.
+func (se *ShardedElector) reconcile(ctx context.Context) {
+	identities, err := se.candidates(ctx)
+	if err != nil {
+		// keep renewing, but do not move shards around
+		klog.Errorf("error listing candidates of %v: %v", se.registry.Describe(), err)
+	}
+	identity := se.config.LockConfig.Identity
+
+	for _, s := range se.shards {
+		se.lock.Lock()
+		leading, stopping := s.leading, s.stopping
+		se.lock.Unlock()
+		if stopping {
+			continue
+		}
+
+		owner := ""
+		if len(identities) > 0 {
+			owner = identities[s.index%len(identities)]
+		}
+		switch {
+		case leading && owner != "" && owner != identity:
+			klog.Infof("handing over shard %v to %v", s.index, owner)
+			se.stop(s, true)
+		case leading:
+			se.renew(ctx, s)
+		case owner == identity:
+			se.acquire(ctx, s)
+		}
+	}
+}
+
+// candidates returns the identities of the live candidates in order.
+func (se *ShardedElector) candidates(ctx context.Context) ([]string, error) {
+	candidates, err := se.registry.Candidates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	identities := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		identities = append(identities, candidate.Identity)
+	}
+	sort.Strings(identities)
+	return identities, nil
+}
+
+// acquire tries to acquire the lease of s and starts leading it on success.
+func (se *ShardedElector) acquire(ctx context.Context, s *shard) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, se.config.RetryPeriod)
+	defer cancel()
+	if err := s.elector.tryAcquireOrRenew(timeoutCtx); err != nil {
+		klog.V(4).Infof("failed to acquire shard %v: %v", s.index, err)
+		return
+	}
+	s.elector.metrics.leaderOn(s.elector.config.Name)
+	klog.Infof("successfully acquired shard %v", s.index)
+
+	leaderCtx, cancelLeader := context.WithCancel(ctx)
+	done := make(chan struct{})
+	se.lock.Lock()
+	s.leading = true
+	s.cancel = cancelLeader
+	s.done = done
+	s.renewed = s.elector.clock.Now()
+	se.lock.Unlock()
+
+	// the token is taken before the next renewal moves the revision on
+	leaderCtx = withFencingToken(leaderCtx, s.elector.newFencingToken())
+	go func() {
+		defer close(done)
+		se.config.Callbacks.OnStartedLeading(leaderCtx, s.index)
+	}()
+}
+
+// renew renews the lease of s and stops leading it if the lease is held by
+// another candidate or could not be renewed within RenewDeadline.
+func (se *ShardedElector) renew(ctx context.Context, s *shard) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, se.config.RetryPeriod)
+	defer cancel()
+	err := s.elector.tryAcquireOrRenew(timeoutCtx)
+	if err == nil {
+		se.lock.Lock()
+		s.renewed = s.elector.clock.Now()
+		se.lock.Unlock()
+		return
+	}
+	if errors.Is(err, errYield) {
+		klog.Infof("yielding shard %v", s.index)
+		se.stop(s, false)
+		return
+	}
+
+	se.lock.Lock()
+	expired := s.elector.clock.Since(s.renewed) > se.config.RenewDeadline
+	se.lock.Unlock()
+	if errors.Is(err, errLeaseHeld) || expired {
+		klog.Infof("failed to renew shard %v: %v", s.index, err)
+		s.elector.metrics.renewFailed(s.elector.config.Name)
+		se.stop(s, false)
+	}
+}
+
+// stop stops leading s, and releases its lease if release is true. The
+// returned channel is closed once s stopped, nil if s was not leading.
+func (se *ShardedElector) stop(s *shard, release bool) <-chan struct{} {
+	se.lock.Lock()
+	if !s.leading || s.stopping {
+		se.lock.Unlock()
+		return nil
+	}
+	s.stopping = true
+	cancel, done := s.cancel, s.done
+	se.lock.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		cancel()
+		<-done
+		if release {
+			s.elector.release()
+		}
+		s.elector.metrics.leaderOff(s.elector.config.Name)
+		se.config.Callbacks.OnStoppedLeading(s.index)
+
+		se.lock.Lock()
+		defer se.lock.Unlock()
+		s.leading = false
+		s.stopping = false
+		s.cancel = nil
+		s.done = nil
+	}()
+	return stopped
+}
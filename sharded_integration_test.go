@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/khh403/leaderelection"
+	rl "github.com/khh403/leaderelection/resourcelock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const testShards = 4
+
+// shardLeaders tracks which candidate runs OnStartedLeading for each shard,
+// across the candidates of a test.
+type shardLeaders struct {
+	mu       sync.Mutex
+	leaders  map[int]string
+	overlaps []string
+}
+
+func (l *shardLeaders) start(t *testing.T, shard int, id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if leader, ok := l.leaders[shard]; ok {
+		t.Errorf("%v started leading shard %v while %v leads it", id, shard, leader)
+	}
+	l.leaders[shard] = id
+}
+
+func (l *shardLeaders) stop(shard int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.leaders, shard)
+}
+
+// shardCandidate runs a ShardedElector for the election named after the test.
+type shardCandidate struct {
+	id     string
+	se     *leaderelection.ShardedElector
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	stopped []int
+}
+
+func newShardClient(t *testing.T) (*clientv3.Client, *shardLeaders) {
+	t.Helper()
+	client := newClient(t)
+	t.Cleanup(func() {
+		client.Delete(context.Background(), "/integration/"+t.Name(), clientv3.WithPrefix())
+	})
+	return client, &shardLeaders{leaders: map[int]string{}}
+}
+
+// startShardCandidate starts a candidate leading some of testShards shards.
+// OnStartedLeading lingers for linger after its context is cancelled.
+func startShardCandidate(t *testing.T, client *clientv3.Client, leaders *shardLeaders, id string, linger time.Duration) *shardCandidate {
+	t.Helper()
+	c := &shardCandidate{id: id, done: make(chan struct{})}
+	se, err := leaderelection.NewShardedElector(leaderelection.ShardedElectionConfig{
+		Client:        client,
+		Namespace:     "/integration",
+		Name:          t.Name(),
+		Shards:        testShards,
+		LockConfig:    rl.ResourceLockConfig{Identity: id},
+		LeaseDuration: testLeaseDuration,
+		RenewDeadline: testRenewDeadline,
+		RetryPeriod:   testRetryPeriod,
+		Callbacks: leaderelection.ShardCallbacks{
+			OnStartedLeading: func(ctx context.Context, shard int) {
+				leaders.start(t, shard, id)
+				<-ctx.Done()
+				leaders.stop(shard)
+				time.Sleep(linger)
+			},
+			OnStoppedLeading: func(shard int) {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				c.stopped = append(c.stopped, shard)
+			},
+		},
+		ReleaseOnCancel: true,
+	})
+	if err != nil {
+		t.Fatalf("error creating sharded elector %v: %v", id, err)
+	}
+	c.se = se
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go func() {
+		defer close(c.done)
+		se.Run(ctx)
+	}()
+	t.Cleanup(c.stop)
+	return c
+}
+
+// stop stops the candidate and waits for Run to return.
+func (c *shardCandidate) stop() {
+	c.cancel()
+	<-c.done
+}
+
+// stoppedShards returns the shards OnStoppedLeading was called for.
+func (c *shardCandidate) stoppedShards() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int(nil), c.stopped...)
+}
+
+// waitForShards waits until every candidate leads the shards given for it.
+func waitForShards(t *testing.T, want map[*shardCandidate][]int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		balanced := true
+		for c, shards := range want {
+			if !reflect.DeepEqual(c.se.LeadingShards(), shards) {
+				balanced = false
+			}
+		}
+		if balanced {
+			return
+		}
+		if time.Now().After(deadline) {
+			for c, shards := range want {
+				t.Errorf("%v leads shards %v, want %v", c.id, c.se.LeadingShards(), shards)
+			}
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShardedSingleCandidateLeadsAllShards(t *testing.T) {
+	client, leaders := newShardClient(t)
+	a := startShardCandidate(t, client, leaders, "a", 0)
+	waitForShards(t, map[*shardCandidate][]int{a: {0, 1, 2, 3}})
+}
+
+func TestShardedCandidatesJoinAndLeave(t *testing.T) {
+	client, leaders := newShardClient(t)
+	a := startShardCandidate(t, client, leaders, "a", 0)
+	waitForShards(t, map[*shardCandidate][]int{a: {0, 1, 2, 3}})
+
+	// shard i goes to the i-th candidate modulo 2, ordered by identity
+	b := startShardCandidate(t, client, leaders, "b", 0)
+	waitForShards(t, map[*shardCandidate][]int{a: {0, 2}, b: {1, 3}})
+
+	c := startShardCandidate(t, client, leaders, "c", 0)
+	waitForShards(t, map[*shardCandidate][]int{a: {0, 3}, b: {1}, c: {2}})
+
+	a.stop()
+	waitForShards(t, map[*shardCandidate][]int{b: {0, 2}, c: {1, 3}})
+}
+
+func TestShardedRunWaitsForOnStoppedLeading(t *testing.T) {
+	client, leaders := newShardClient(t)
+	a := startShardCandidate(t, client, leaders, "a", 100*time.Millisecond)
+	waitForShards(t, map[*shardCandidate][]int{a: {0, 1, 2, 3}})
+
+	a.stop()
+	stopped := a.stoppedShards()
+	if len(stopped) != testShards {
+		t.Errorf("Run returned before OnStoppedLeading ran for every shard, got %v", stopped)
+	}
+	if shards := a.se.LeadingShards(); len(shards) != 0 {
+		t.Errorf("expected no shard to be led after Run returned, got %v", shards)
+	}
+}
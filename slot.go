@@ -0,0 +1,57 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"context"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+)
+
+// Locks implementing resourcelock.Slotter, like resourcelock.SemaphoreLock,
+// let several clients lead at once, each holding one slot of the lock.
+
+type slotKey struct{}
+
+// withSlot returns a copy of ctx carrying the index of the held slot.
+func withSlot(ctx context.Context, slot int) context.Context {
+	return context.WithValue(ctx, slotKey{}, slot)
+}
+
+// SlotFromContext returns the index of the slot of the lock held in the
+// leadership term carried by the context passed to OnStartedLeading. ok is
+// false if the lock is not a resourcelock.Slotter.
+func SlotFromContext(ctx context.Context) (slot int, ok bool) {
+	slot, ok = ctx.Value(slotKey{}).(int)
+	return slot, ok
+}
+
+// Slot returns the index of the slot held in the current leadership term, or
+// -1 if this client is not leading or the lock is not a resourcelock.Slotter.
+func (le *LeaderElector) Slot() int {
+	if !le.IsLeader() {
+		return -1
+	}
+	return int(le.slot.Load())
+}
+
+// newSlot returns the index of the slot held in a term that was just
+// acquired, -1 if the lock has no slots.
+func (le *LeaderElector) newSlot() int {
+	if slotter, ok := le.config.Lock.(rl.Slotter); ok {
+		return slotter.Slot()
+	}
+	return -1
+}
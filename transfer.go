@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2023 khh403
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+*/
+
+package leaderelection
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	rl "github.com/khh403/leaderelection/resourcelock"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// transferRequest asks the renew loop of the current term to hand over
+// leadership to identity and to report the outcome on done.
+type transferRequest struct {
+	identity string
+	done     chan error
+}
+
+// TransferTo hands over leadership to the candidate identity. The client
+// stops leading and, once OnStartedLeading returned, releases the lease with
+// identity as its preferred holder, so that no other candidate may acquire it
+// within LeaseDuration. TransferTo returns once the lease was handed over, or
+// ErrNotLeader if the client is not leading.
+func (le *LeaderElector) TransferTo(ctx context.Context, identity string) error {
+	if identity == "" || identity == le.config.Lock.Identity() {
+		return fmt.Errorf("cannot transfer leadership to %q", identity)
+	}
+	done, err := le.requestTransfer(identity)
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// requestTransfer stops the current term and asks it to hand over leadership
+// to identity.
+func (le *LeaderElector) requestTransfer(identity string) (<-chan error, error) {
+	le.termLock.Lock()
+	defer le.termLock.Unlock()
+	if le.stopTerm == nil {
+		return nil, ErrNotLeader
+	}
+	if le.transfer != nil {
+		return nil, fmt.Errorf("leadership is already being transferred to %v", le.transfer.identity)
+	}
+	le.transfer = &transferRequest{
+		identity: identity,
+		done:     make(chan error, 1),
+	}
+	le.stopTerm()
+	return le.transfer.done, nil
+}
+
+// startTerm registers stop as the function that stops renewing the lease of
+// the current term.
+func (le *LeaderElector) startTerm(stop context.CancelFunc) {
+	le.termLock.Lock()
+	defer le.termLock.Unlock()
+	le.stopTerm = stop
+}
+
+// endTerm ends the current term and returns its pending transfer, if any.
+func (le *LeaderElector) endTerm() *transferRequest {
+	le.termLock.Lock()
+	defer le.termLock.Unlock()
+	transfer := le.transfer
+	le.stopTerm = nil
+	le.transfer = nil
+	return transfer
+}
+
+// handOver releases the lease with identity as its preferred holder.
+func (le *LeaderElector) handOver(identity string) error {
+	if !le.IsLeader() {
+		return ErrLeadershipLost
+	}
+	now := metav1.NewTime(le.clock.Now())
+	leaderElectionRecord := rl.LeaderElectionRecord{
+		LeaderTransitions:    le.getObservedRecord().LeaderTransitions,
+		LeaseDurationSeconds: int(le.config.LeaseDuration / time.Second),
+		RenewTime:            now,
+		AcquireTime:          now,
+		PreferredHolder:      identity,
+	}
+	if err := le.config.Lock.Update(context.TODO(), leaderElectionRecord); err != nil {
+		return err
+	}
+
+	le.setObservedRecord(&leaderElectionRecord)
+	return nil
+}
+
+// isPreferredHolder reports whether record allows this client to acquire it
+// while it is valid.
+func (le *LeaderElector) isPreferredHolder(record *rl.LeaderElectionRecord) bool {
+	return len(record.PreferredHolder) == 0 || record.PreferredHolder == le.config.Lock.Identity()
+}